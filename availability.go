@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// availabilitySegment is a period in which a test consistently passed, was degraded, failed or was in
+// maintenance. The state of the segment is known from its start until shortly after the last observation in
+// it; see maxGap.
+type availabilitySegment struct {
+	Start       time.Time `json:"start"`
+	Last        time.Time `json:"last"`
+	Result      bool      `json:"result"`
+	Degraded    bool      `json:"degraded,omitempty"`
+	Maintenance bool      `json:"maintenance,omitempty"`
+}
+
+type availabilitySeries struct {
+	Site     string                `json:"site"`
+	Key      string                `json:"key"`
+	Name     string                `json:"name"`
+	Segments []availabilitySegment `json:"segments"`
+}
+
+// availabilityLog records the outcome of every run per site and test. Only changes of state are stored, so
+// months of history fit in memory, and the log is saved to the state store after every run.
+type availabilityLog struct {
+	mutex     sync.Mutex
+	retention time.Duration
+	// maxGap is how long a state is assumed to last after it was last observed. Time after that without
+	// observations, e.g. while the app was down, counts as unknown: neither up nor down.
+	maxGap time.Duration
+	series map[string]*availabilitySeries
+	store  *stateStore
+}
+
+// Outage is a period in which a test failed. End is nil while the outage lasts.
+type Outage struct {
+	Start           time.Time  `json:"start"`
+	End             *time.Time `json:"end,omitempty"`
+	DurationSeconds float64    `json:"durationSeconds"`
+}
+
+// AvailabilityReport describes the availability of a single test in a single site over a window. Time in
+// which the test was degraded counts as available, and is also reported separately.
+type AvailabilityReport struct {
+	Site         string   `json:"site"`
+	Key          string   `json:"key"`
+	Name         string   `json:"name"`
+	Window       string   `json:"window"`
+	Availability float64  `json:"availability"`
+	Observed     float64  `json:"observedSeconds"`
+	Degraded     float64  `json:"degradedSeconds"`
+	MTTRSeconds  float64  `json:"mttrSeconds"`
+	Outages      []Outage `json:"outages"`
+}
+
+const availabilityState = "availability"
+
+func availabilityLogNew(retention, maxGap time.Duration, store *stateStore) *availabilityLog {
+	a := &availabilityLog{retention: retention, maxGap: maxGap, series: make(map[string]*availabilitySeries), store: store}
+	if err := store.load(availabilityState, &a.series); err != nil {
+		log.Printf("Unable to load availability, starting afresh: %v", err)
+	}
+	return a
+}
+
+// localSite returns the name under which the results of this instance are recorded.
+func localSite() string {
+	if site := os.Getenv("SITE"); site != "" {
+		return site
+	}
+	return "local"
+}
+
+// parseWindow parses a duration that, in addition to time.ParseDuration, accepts days, e.g. "7d".
+func parseWindow(window string) (time.Duration, error) {
+	if days := strings.TrimSuffix(window, "d"); days != window {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid window %q", window)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(window)
+}
+
+func (a *availabilityLog) record(site string, at time.Time, results []SmokeTestResult) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, result := range results {
+		id := site + "/" + result.Key
+		series, ok := a.series[id]
+		if !ok {
+			series = &availabilitySeries{Site: site, Key: result.Key}
+			a.series[id] = series
+		}
+		series.Name = result.Name
+
+		segment := availabilitySegment{Start: at, Last: at, Result: result.Result, Degraded: result.Degraded, Maintenance: result.Maintenance != ""}
+		n := len(series.Segments)
+		if n == 0 || series.Segments[n-1].Result != segment.Result || series.Segments[n-1].Degraded != segment.Degraded ||
+			series.Segments[n-1].Maintenance != segment.Maintenance || at.Sub(series.Segments[n-1].Last) > a.maxGap {
+			series.Segments = append(series.Segments, segment)
+		} else {
+			series.Segments[n-1].Last = at
+		}
+
+		// Drop segments that ended before the retention period.
+		for len(series.Segments) > 1 && series.Segments[1].Start.Before(at.Add(-a.retention)) {
+			series.Segments = series.Segments[1:]
+		}
+	}
+
+	if err := a.store.save(availabilityState, a.series); err != nil {
+		log.Printf("Unable to save availability: %v", err)
+	}
+}
+
+// end returns until when the state of the i-th segment is known: the start of the next segment, or, when
+// observations stopped, the last observation plus maxGap. contiguous tells whether the next segment starts
+// right at the end, i.e. whether the change of state was observed.
+func (a *availabilityLog) end(segments []availabilitySegment, i int, now time.Time) (end time.Time, contiguous bool) {
+	end = now
+	if i+1 < len(segments) {
+		end = segments[i+1].Start
+	}
+	if known := segments[i].Last.Add(a.maxGap); known.Before(end) {
+		return known, false
+	}
+	return end, i+1 < len(segments)
+}
+
+// report returns the availability of all tests, optionally filtered on site and key, over the given window.
+func (a *availabilityLog) report(window time.Duration, windowName, site, key string, now time.Time) []AvailabilityReport {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	reports := make([]AvailabilityReport, 0)
+	windowStart := now.Add(-window)
+	for _, series := range a.series {
+		if (site != "" && series.Site != site) || (key != "" && series.Key != key) {
+			continue
+		}
+
+		report := AvailabilityReport{Site: series.Site, Key: series.Key, Name: series.Name, Window: windowName, Outages: []Outage{}}
+		var up, degraded, observed, repaired time.Duration
+		var repairs int
+		for i, segment := range series.Segments {
+			end, contiguous := a.end(series.Segments, i, now)
+			if !end.After(windowStart) || segment.Maintenance {
+				continue
+			}
+			start := segment.Start
+			if start.Before(windowStart) {
+				start = windowStart
+			}
+
+			observed += end.Sub(start)
+			if segment.Result {
+				up += end.Sub(start)
+				if segment.Degraded {
+					degraded += end.Sub(start)
+				}
+				continue
+			}
+
+			outage := Outage{Start: start, DurationSeconds: end.Sub(start).Seconds()}
+			if end.Before(now) {
+				outageEnd := end
+				outage.End = &outageEnd
+			}
+			// Only an observed recovery counts for MTTR: after a gap it is unknown when the test recovered.
+			if contiguous {
+				repaired += end.Sub(start)
+				repairs++
+			}
+			report.Outages = append(report.Outages, outage)
+		}
+
+		if observed == 0 {
+			continue
+		}
+		report.Observed = observed.Seconds()
+		report.Degraded = degraded.Seconds()
+		report.Availability = 100 * float64(up) / float64(observed)
+		if repairs > 0 {
+			report.MTTRSeconds = (repaired / time.Duration(repairs)).Seconds()
+		}
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Site != reports[j].Site {
+			return reports[i].Site < reports[j].Site
+		}
+		return reports[i].Key < reports[j].Key
+	})
+	return reports
+}
+
+func writeAvailabilityCSV(w io.Writer, reports []AvailabilityReport) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"site", "key", "name", "window", "availability", "observed_seconds", "degraded_seconds", "outages", "mttr_seconds"})
+	for _, r := range reports {
+		writer.Write([]string{
+			r.Site, r.Key, strings.ReplaceAll(r.Name, "\n", " "), r.Window,
+			strconv.FormatFloat(r.Availability, 'f', 3, 64),
+			strconv.FormatFloat(r.Observed, 'f', 0, 64),
+			strconv.FormatFloat(r.Degraded, 'f', 0, 64),
+			strconv.Itoa(len(r.Outages)),
+			strconv.FormatFloat(r.MTTRSeconds, 'f', 0, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeOutagesCSV(w io.Writer, reports []AvailabilityReport) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"site", "key", "name", "window", "start", "end", "duration_seconds"})
+	for _, r := range reports {
+		for _, o := range r.Outages {
+			end := ""
+			if o.End != nil {
+				end = o.End.Format(time.RFC3339)
+			}
+			writer.Write([]string{
+				r.Site, r.Key, strings.ReplaceAll(r.Name, "\n", " "), r.Window,
+				o.Start.Format(time.RFC3339), end,
+				strconv.FormatFloat(o.DurationSeconds, 'f', 0, 64),
+			})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// canaryName names the record, key or object of the canary. It does not end in a timestamp, so the
+	// sweeper leaves it alone.
+	canaryName = "smoketest-canary"
+
+	canaryTest = "Durability canary"
+)
+
+// canaryStore reads and writes the canary of a service.
+type canaryStore interface {
+	read() (payload string, found bool, err error)
+	write(payload string) error
+}
+
+// canary is a sentinel that is written to a service once and must survive every run after, including
+// upgrades and failovers of the service. Unlike the records of a run, it is never deleted, and it is never
+// written again without being asked to: a missing or corrupted canary fails every run until it is
+// bootstrapped through POST /v1/canaries/{key}.
+type canary struct {
+	key    string
+	ledger *canaryLedger
+}
+
+// canaries holds the state of the canaries of all tests. It is set by the program before the tests are
+// constructed.
+var canaries *canaryLedger
+
+func canaryNew(key string) *canary {
+	canaries.register(key)
+	return &canary{key: key, ledger: canaries}
+}
+
+// checksum covers the key of the test and the time the canary was written.
+func (c *canary) checksum(written time.Time) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", c.key, written.UnixNano())))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *canary) payload(written time.Time) string {
+	return fmt.Sprintf("%d:%s", written.UnixNano(), c.checksum(written))
+}
+
+// check verifies that the canary exists and is intact. The canary is only written when it was bootstrapped;
+// otherwise a missing or corrupted canary fails the step, also after a restart of the app, since whether it
+// was established is kept in the state store.
+func (c *canary) check(store canaryStore, result *SmokeTestResult) error {
+	marker := c.ledger.get(c.key)
+
+	payload, found, err := store.read()
+	if err != nil {
+		return err
+	}
+
+	written, intact := c.parse(payload)
+	if marker.Bootstrap && (!found || !intact) {
+		now := time.Now()
+		if err := store.write(c.payload(now)); err != nil {
+			return fmt.Errorf("Unable to write canary: %v", err)
+		}
+		c.ledger.set(c.key, canaryMarker{Established: now, LastSeen: now})
+		result.Details = "Canary bootstrapped"
+		return nil
+	}
+
+	lastSeen := "never"
+	if !marker.LastSeen.IsZero() {
+		lastSeen = marker.LastSeen.Format(time.RFC3339)
+	}
+
+	if !found {
+		if marker.Established.IsZero() {
+			return fmt.Errorf("Canary not found and never established: bootstrap it through POST /v1/canaries/%s on the first deployment", c.key)
+		}
+		return fmt.Errorf("Canary lost: established %s, last seen %s", marker.Established.Format(time.RFC3339), lastSeen)
+	}
+	if !intact {
+		return fmt.Errorf("Canary corrupted (%q): last seen intact %s", payload, lastSeen)
+	}
+
+	if marker.Established.IsZero() {
+		marker.Established = written
+	}
+	// A bootstrap asked for while the canary was intact is not kept around to mask a later loss.
+	marker.Bootstrap = false
+	marker.LastSeen = time.Now()
+	c.ledger.set(c.key, marker)
+
+	result.Details = fmt.Sprintf("Written %s, last seen %s", written.Format(time.RFC3339), lastSeen)
+	return nil
+}
+
+// parse returns the time the canary was written, if the payload is intact.
+func (c *canary) parse(payload string) (time.Time, bool) {
+	parts := strings.SplitN(payload, ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	written := time.Unix(0, nanos)
+	if parts[1] != c.checksum(written) {
+		return time.Time{}, false
+	}
+	return written, true
+}
+
+// canaryMarker is the state of the canary of a single test.
+type canaryMarker struct {
+	Established time.Time `json:"established,omitempty"`
+	LastSeen    time.Time `json:"lastSeen,omitempty"`
+	// Bootstrap lets the next run write the canary: on the first deployment, or after a loss was dealt with.
+	Bootstrap bool `json:"bootstrap,omitempty"`
+}
+
+const canaryState = "canaries"
+
+// canaryLedger keeps the markers of the canaries in the state store, so a canary that was established
+// before a restart is still known to be.
+type canaryLedger struct {
+	mutex   sync.Mutex
+	store   *stateStore
+	markers map[string]canaryMarker
+}
+
+func canaryLedgerNew(store *stateStore) *canaryLedger {
+	l := &canaryLedger{store: store, markers: make(map[string]canaryMarker)}
+	if err := store.load(canaryState, &l.markers); err != nil {
+		log.Printf("Unable to load canary state: %v", err)
+	}
+	return l
+}
+
+func (l *canaryLedger) register(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.markers[key]; !ok {
+		l.markers[key] = canaryMarker{}
+	}
+}
+
+func (l *canaryLedger) get(key string) canaryMarker {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.markers[key]
+}
+
+func (l *canaryLedger) set(key string, marker canaryMarker) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.markers[key] = marker
+	l.save()
+}
+
+// bootstrap lets the next run of the test write its canary. It returns false for tests without a canary.
+func (l *canaryLedger) bootstrap(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	marker, ok := l.markers[key]
+	if !ok {
+		return false
+	}
+	marker.Bootstrap = true
+	l.markers[key] = marker
+	l.save()
+	return true
+}
+
+// all returns the markers of all canaries by test key.
+func (l *canaryLedger) all() map[string]canaryMarker {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	markers := make(map[string]canaryMarker, len(l.markers))
+	for key, marker := range l.markers {
+		markers[key] = marker
+	}
+	return markers
+}
+
+// save must be called with the mutex held.
+func (l *canaryLedger) save() {
+	if err := l.store.save(canaryState, l.markers); err != nil {
+		log.Printf("Unable to save canary state: %v", err)
+	}
+}
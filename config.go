@@ -1,15 +1,46 @@
 package main
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type SmokeTestConfig struct {
-	KubeconfigPath       string   `envconfig:"KUBECONFIG_PATH" required:"false"`
-	K8sNamespace         string   `envconfig:"K8S_NAMESPACE" required:"false"`
-	K8sTestImage         string   `envconfig:"K8S_TESTIMAGE" required:"false"`
-	K8sImgPullSecret     string   `envconfig:"K8S_IMG_PULL_SECRET" required:"false"`
-	K8sIngHosts          []string `envconfig:"K8S_ING_HOSTS" required:"false"`
-	K8sIngHostsTlsSecret []string `envconfig:"K8S_ING_HOSTS_TLS" required:"false"`
-	K8sIngHostsClass     []string `envconfig:"K8S_ING_HOSTS_CLASS" required:"false"`
+	KubeconfigPath             string        `envconfig:"KUBECONFIG_PATH" required:"false"`
+	K8sNamespace               string        `envconfig:"K8S_NAMESPACE" required:"false"`
+	K8sTestImage               string        `envconfig:"K8S_TESTIMAGE" required:"false"`
+	K8sImgPullSecret           string        `envconfig:"K8S_IMG_PULL_SECRET" required:"false"`
+	K8sIngHosts                []string      `envconfig:"K8S_ING_HOSTS" required:"false"`
+	K8sIngHostsTlsSecret       []string      `envconfig:"K8S_ING_HOSTS_TLS" required:"false"`
+	K8sIngHostsClass           []string      `envconfig:"K8S_ING_HOSTS_CLASS" required:"false"`
+	SweepTTL                   time.Duration `envconfig:"SWEEP_TTL" default:"15m"`
+	SweepInterval              time.Duration `envconfig:"SWEEP_INTERVAL" default:"1h"`
+	CACerts                    string        `envconfig:"CA_CERTS" required:"false"`
+	CACertFiles                []string      `envconfig:"CA_CERT_FILES" required:"false"`
+	HTTPTimeout                time.Duration `envconfig:"HTTP_TIMEOUT" default:"30s"`
+	FederationPeers            []string      `envconfig:"FEDERATION_PEERS" required:"false"`
+	FederationInterval         time.Duration `envconfig:"FEDERATION_INTERVAL" default:"5m"`
+	HistorySize                int           `envconfig:"HISTORY_SIZE" default:"500"`
+	SLAWindows                 []string      `envconfig:"SLA_WINDOWS" default:"24h,7d,30d"`
+	SLAMaxGap                  time.Duration `envconfig:"SLA_MAX_GAP" default:"15m"`
+	StateDir                   string        `envconfig:"STATE_DIR" required:"false"`
+	AdminToken                 string        `envconfig:"ADMIN_TOKEN" required:"false"`
+	DBTLSRequired              bool          `envconfig:"DB_TLS_REQUIRED" default:"false"`
+	DBConnectionDegradePercent int           `envconfig:"DB_CONNECTION_DEGRADE_PERCENT" default:"80"`
+	TLSExpiryWarning           time.Duration `envconfig:"TLS_EXPIRY_WARNING" default:"720h"`
+	MySQLCluster               string        `envconfig:"MYSQL_CLUSTER" required:"false"`
+	MySQLClusterSize           int           `envconfig:"MYSQL_CLUSTER_SIZE" required:"false"`
+	MySQLMaxReplicationLag     time.Duration `envconfig:"MYSQL_MAX_REPLICATION_LAG" default:"30s"`
+	PostgresMaxReplicationLag  time.Duration `envconfig:"POSTGRES_MAX_REPLICATION_LAG" default:"30s"`
+	PostgresVisibilityTimeout  time.Duration `envconfig:"POSTGRES_VISIBILITY_TIMEOUT" default:"10s"`
+	PostgresMinVersion         string        `envconfig:"POSTGRES_MIN_VERSION" required:"false"`
+	PostgresRequiredExtensions []string      `envconfig:"POSTGRES_REQUIRED_EXTENSIONS" required:"false"`
+	RabbitMqTimeout            time.Duration `envconfig:"RABBITMQ_TIMEOUT" default:"10s"`
+	RabbitMqQueueTypes         []string      `envconfig:"RABBITMQ_QUEUE_TYPES" required:"false"`
+	RabbitMqExpectedNodes      int           `envconfig:"RABBITMQ_EXPECTED_NODES" default:"0"`
+	RabbitMqIsolationVhost     string        `envconfig:"RABBITMQ_ISOLATION_VHOST" default:"/"`
+	PostgresNotifyTimeout      time.Duration `envconfig:"POSTGRES_NOTIFY_TIMEOUT" default:"5s"`
 }
 
 func smokeTestsConfigLoad() (SmokeTestConfig, error) {
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SiteStatus holds the latest results retrieved from a single smoke test deployment.
+type SiteStatus struct {
+	Site    string            `json:"site"`
+	URL     string            `json:"url"`
+	RunID   string            `json:"runId,omitempty"`
+	Fetched *time.Time        `json:"fetched,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Results []SmokeTestResult `json:"results"`
+}
+
+// SiteDiff describes a test that passes in some sites and fails in others, or that is degraded in some of
+// the sites where it passes. Degraded sites are also listed as passing.
+type SiteDiff struct {
+	Key      string   `json:"key"`
+	Name     string   `json:"name"`
+	Passing  []string `json:"passing"`
+	Degraded []string `json:"degraded"`
+	Failing  []string `json:"failing"`
+}
+
+// FederatedStatus is the combined view over all sites. It is degraded when all tests pass, but some are
+// degraded.
+type FederatedStatus struct {
+	Result   bool                  `json:"result"`
+	Degraded bool                  `json:"degraded"`
+	Sites    map[string]SiteStatus `json:"sites"`
+	Diffs    []SiteDiff            `json:"diffs"`
+}
+
+type federationPeer struct {
+	site string
+	url  string
+}
+
+// federation polls the latest completed runs of the smoke test deployments of other sites (foundations) and
+// merges their results. Polling doesn't start a run at the peer: the peer's own schedule does.
+type federation struct {
+	peers      []federationPeer
+	httpClient *http.Client
+	uptime     *availabilityLog
+	windows    *maintenanceSchedule
+
+	mutex sync.Mutex
+	sites map[string]SiteStatus
+}
+
+// federationNew returns nil when no peers are configured, i.e. when this instance is not an aggregator.
+// Peers are configured as "site=url" pairs, the url being the base url of the peer's smoke tests.
+func federationNew(config SmokeTestConfig, uptime *availabilityLog, windows *maintenanceSchedule) (*federation, error) {
+	if len(config.FederationPeers) == 0 {
+		return nil, nil
+	}
+
+	f := &federation{sites: make(map[string]SiteStatus), uptime: uptime, windows: windows}
+	for _, peer := range config.FederationPeers {
+		parts := strings.SplitN(peer, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid federation peer %q, expected site=url", peer)
+		}
+		f.peers = append(f.peers, federationPeer{site: parts[0], url: strings.TrimSuffix(parts[1], "/")})
+		f.sites[parts[0]] = SiteStatus{Site: parts[0], URL: parts[1], Results: []SmokeTestResult{}}
+	}
+
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	f.httpClient = httpClient
+
+	return f, nil
+}
+
+// pollPeriodically polls once immediately and then every interval. A zero interval only polls once.
+func (f *federation) pollPeriodically(interval time.Duration) {
+	for {
+		f.poll()
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// poll retrieves the status of all peers concurrently.
+func (f *federation) poll() {
+	var wg sync.WaitGroup
+	for _, peer := range f.peers {
+		wg.Add(1)
+		go func(peer federationPeer) {
+			defer wg.Done()
+			run, err := f.fetch(peer)
+
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+
+			status := f.sites[peer.site]
+			if err != nil {
+				// Keep the previous results, but make clear they are stale.
+				log.Printf("Unable to retrieve status of site %s: %v", peer.site, err)
+				status.Error = err.Error()
+			} else {
+				fetched := time.Now()
+				status.Fetched = &fetched
+				status.Error = ""
+				// A run is only recorded once, however often it is polled.
+				if run.ID != status.RunID {
+					f.windows.annotate(peer.site, run.Started, run.Results)
+					status.RunID = run.ID
+					status.Results = run.Results
+					f.uptime.record(peer.site, run.Started, run.Results)
+				}
+			}
+			f.sites[peer.site] = status
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// fetch retrieves the latest completed run of a peer.
+func (f *federation) fetch(peer federationPeer) (runRecord, error) {
+	var run runRecord
+
+	response, err := f.httpClient.Get(peer.url + "/v1/runs/latest")
+	if err != nil {
+		return run, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return run, fmt.Errorf("No completed run yet")
+	}
+	if response.StatusCode != http.StatusOK {
+		return run, fmt.Errorf("Received unexpected status code %d", response.StatusCode)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&run); err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+func (f *federation) status() FederatedStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	status := FederatedStatus{Result: true, Sites: make(map[string]SiteStatus), Diffs: []SiteDiff{}}
+	diffs := make(map[string]*SiteDiff)
+	for site, siteStatus := range f.sites {
+		status.Sites[site] = siteStatus
+		if siteStatus.Error != "" {
+			status.Result = false
+		}
+
+		for _, result := range withoutMaintenance(siteStatus.Results) {
+			status.Result = status.Result && result.Result
+			status.Degraded = status.Degraded || result.Degraded
+
+			diff, ok := diffs[result.Key]
+			if !ok {
+				diff = &SiteDiff{Key: result.Key, Name: result.Name, Passing: []string{}, Degraded: []string{}, Failing: []string{}}
+				diffs[result.Key] = diff
+			}
+			if result.Result {
+				diff.Passing = append(diff.Passing, site)
+				if result.Degraded {
+					diff.Degraded = append(diff.Degraded, site)
+				}
+			} else {
+				diff.Failing = append(diff.Failing, site)
+			}
+		}
+	}
+
+	status.Degraded = status.Degraded && status.Result
+
+	for _, diff := range diffs {
+		mixed := len(diff.Passing) > 0 && len(diff.Failing) > 0
+		partlyDegraded := len(diff.Degraded) > 0 && len(diff.Degraded) < len(diff.Passing)
+		if mixed || partlyDegraded {
+			sort.Strings(diff.Passing)
+			sort.Strings(diff.Degraded)
+			sort.Strings(diff.Failing)
+			status.Diffs = append(status.Diffs, *diff)
+		}
+	}
+	sort.Slice(status.Diffs, func(i, j int) bool { return status.Diffs[i].Key < status.Diffs[j].Key })
+
+	return status
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// runRecord holds the results of a single run of all tests.
+type runRecord struct {
+	ID       string            `json:"id"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished"`
+	Results  []SmokeTestResult `json:"results"`
+}
+
+// historyPoint is the outcome of a single test in a single run.
+type historyPoint struct {
+	RunID       string    `json:"runId"`
+	Time        time.Time `json:"time"`
+	Result      bool      `json:"result"`
+	Degraded    bool      `json:"degraded,omitempty"`
+	DurationMs  int64     `json:"durationMs"`
+	Maintenance string    `json:"maintenance,omitempty"`
+}
+
+// resultHistory keeps the most recent runs in memory.
+type resultHistory struct {
+	mutex sync.Mutex
+	size  int
+	runs  []runRecord
+}
+
+func resultHistoryNew(size int) *resultHistory {
+	return &resultHistory{size: size}
+}
+
+func runIDNew(started time.Time) string {
+	return strconv.FormatInt(started.UnixNano(), 10)
+}
+
+func (h *resultHistory) add(run runRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.runs = append(h.runs, run)
+	if len(h.runs) > h.size {
+		h.runs = h.runs[len(h.runs)-h.size:]
+	}
+}
+
+// latest returns the most recent run.
+func (h *resultHistory) latest() (runRecord, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.runs) == 0 {
+		return runRecord{}, false
+	}
+	return h.runs[len(h.runs)-1], true
+}
+
+// all returns all runs, oldest first.
+func (h *resultHistory) all() []runRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	runs := make([]runRecord, len(h.runs))
+	copy(runs, h.runs)
+	return runs
+}
+
+// forKey returns the outcomes of the test with the given key, oldest first.
+func (h *resultHistory) forKey(key string) []historyPoint {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	points := make([]historyPoint, 0)
+	for _, run := range h.runs {
+		for _, result := range run.Results {
+			if result.Key == key {
+				points = append(points, historyPoint{RunID: run.ID, Time: run.Started, Result: result.Result, Degraded: result.Degraded, DurationMs: result.DurationMs, Maintenance: result.Maintenance})
+			}
+		}
+	}
+	return points
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newTLSConfig returns a TLS configuration that trusts the system roots, the CA certificates configured in
+// the environment (CA_CERTS and CA_CERT_FILES) and the given PEM encoded CA certificates, which typically
+// come from a service binding.
+func newTLSConfig(config SmokeTestConfig, caCerts ...string) (*tls.Config, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if config.CACerts != "" {
+		caCerts = append(caCerts, config.CACerts)
+	}
+	for _, file := range config.CACertFiles {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA certificate file %s: %v", file, err)
+		}
+		caCerts = append(caCerts, string(pem))
+	}
+
+	for _, pem := range caCerts {
+		if pem == "" {
+			continue
+		}
+		if !pool.AppendCertsFromPEM([]byte(pem)) {
+			return nil, fmt.Errorf("Unable to parse PEM encoded CA certificate")
+		}
+	}
+
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+// newHTTPClient returns an HTTP client that verifies server certificates against the CA certificates
+// described at newTLSConfig, honors HTTPS_PROXY/NO_PROXY, times out and identifies itself as the smoke tests.
+func newHTTPClient(config SmokeTestConfig, caCerts ...string) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(config, caCerts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHTTPClientWithTLS(config, tlsConfig), nil
+}
+
+func newHTTPClientWithTLS(config SmokeTestConfig, tlsConfig *tls.Config) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: config.HTTPTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          10,
+	}
+
+	return &http.Client{
+		Transport: &userAgentTransport{userAgent: userAgent(), next: transport},
+		Timeout:   config.HTTPTimeout,
+	}
+}
+
+// userAgent returns the User-Agent sent by the smoke tests, e.g. "cf-smoketests (production site-a)".
+func userAgent() string {
+	sitetype := os.Getenv("TYPE")
+	sitename := os.Getenv("SITE")
+	if sitetype != "" && sitename != "" {
+		return fmt.Sprintf("cf-smoketests (%s %s)", sitetype, sitename)
+	}
+	return "cf-smoketests"
+}
+
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// bindingCACert returns the PEM encoded CA certificate from service binding credentials. Brokers provide it
+// either nested ("tls": {"cert": {"ca": ...}}) or as a flat "tls.cert.ca" key.
+func bindingCACert(creds map[string]interface{}) string {
+	if ca, ok := creds["tls.cert.ca"].(string); ok {
+		return ca
+	}
+	tlsCreds, _ := creds["tls"].(map[string]interface{})
+	cert, _ := tlsCreds["cert"].(map[string]interface{})
+	ca, _ := cert["ca"].(string)
+	return ca
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -23,11 +23,18 @@ const (
 )
 
 type k8sTest struct {
-	client *kubernetes.Clientset
-	config SmokeTestConfig
+	client     *kubernetes.Clientset
+	config     SmokeTestConfig
+	httpClient *http.Client
+
+	// Name (and creation time) of the objects created during the current run.
+	name    string
+	created time.Time
 }
 
-func k8sTestNew(config SmokeTestConfig) SmokeTest {
+func k8sTestNew(config SmokeTestConfig) (test SmokeTest) {
+	defer recoverTestNew(&test, k8sKey, k8sName)
+
 	if config.KubeconfigPath == "" {
 		return nil
 	}
@@ -44,34 +51,36 @@ func k8sTestNew(config SmokeTestConfig) SmokeTest {
 		return nil
 	}
 
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		log.Printf("Unable to create http client: %s", err.Error())
+		return nil
+	}
+
 	return &k8sTest{
-		client: cs,
-		config: config,
+		client:     cs,
+		config:     config,
+		httpClient: httpClient,
 	}
 }
 
 func (k *k8sTest) run() SmokeTestResult {
-
-	var results []SmokeTestResult
-
-	RunTestPart(k.CreateDeployment, "Create Deployment", &results)
-
-	//skip other tests if deployment fails
-	if !results[0].Result {
-		RunTestPart(k.DeleteDeployment, "Delete Deployment", &results)
-		return OverallResult(k8sKey, k8sName, results)
-	}
-
-	RunTestPart(k.CreateService, "Create Service", &results)
-	RunTestPart(k.CreateIngresses, "Create Ingresses", &results)
-
-	RunTestPart(k.TestConnections, "Test Connection", &results)
-
-	RunTestPart(k.DeleteIngresses, "Delete Ingresses", &results)
-	RunTestPart(k.DeleteService, "Delete Service", &results)
-	RunTestPart(k.DeleteDeployment, "Delete Deployment", &results)
-
-	return OverallResult(k8sKey, k8sName, results)
+	k.created = time.Now()
+	k.name = resourceName(smokeTestResourcePrefix, k.created)
+
+	plan := testPlanNew(k8sKey, k8sName)
+	plan.step("Create Deployment", testPartStep(k.CreateDeployment))
+	plan.step("Create Service", testPartStep(k.CreateService), "Create Deployment")
+	plan.step("Create Ingresses", testPartStep(k.CreateIngresses), "Create Deployment")
+	plan.step("Test Connection", testPartStep(k.TestConnections), "Create Service", "Create Ingresses")
+
+	// Only what was created is deleted; objects left behind by a create that failed halfway are removed by
+	// the sweeper.
+	plan.cleanup("Delete Deployment", testPartStep(k.DeleteDeployment), "Create Deployment")
+	plan.cleanup("Delete Service", testPartStep(k.DeleteService), "Create Service")
+	plan.cleanup("Delete Ingresses", testPartStep(k.DeleteIngresses), "Create Ingresses")
+
+	return plan.run()
 }
 
 // CreateDeployment creates a dummy nginx deployment of 2 pods
@@ -87,25 +96,21 @@ func (k *k8sTest) CreateDeployment() (interface{}, error) {
 			Kind:       "deployment",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "smoketest",
-			Labels: map[string]string{
-				"testName": "deployment",
-			},
+			Name:   k.name,
+			Labels: k.labels(map[string]string{"testName": "deployment"}),
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: &numReplicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
-					"app": "smoketest",
+					"app": k.name,
 				},
 			},
 			MinReadySeconds: int32(7),
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Name: "nginx",
-					Labels: map[string]string{
-						"app": "smoketest",
-					},
+					Name:   "nginx",
+					Labels: k.labels(map[string]string{"app": k.name}),
 				},
 				Spec: corev1.PodSpec{
 					//					Volumes:                       []corev1.Volume{},
@@ -132,7 +137,7 @@ func (k *k8sTest) CreateDeployment() (interface{}, error) {
 func (k *k8sTest) DeleteDeployment() (interface{}, error) {
 	log.Println("Deleting k8s deployment")
 	ctx := context.Background()
-	if err := k.client.AppsV1().Deployments(k.config.K8sNamespace).Delete(ctx, "smoketest", metav1.DeleteOptions{}); err != nil {
+	if err := k.client.AppsV1().Deployments(k.config.K8sNamespace).Delete(ctx, k.name, metav1.DeleteOptions{}); err != nil {
 		log.Println(err)
 		return nil, fmt.Errorf("failed to delete deployment: %v", err)
 	}
@@ -186,7 +191,8 @@ func (k *k8sTest) CreateIngress(hostname string, tlsSecret string, ingressClass
 			APIVersion: "networking.k8s.io/v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "smoketest-ingress-" + hostname,
+			Name:   k.ingressName(hostname),
+			Labels: k.labels(nil),
 		},
 		Spec: networkingV1.IngressSpec{
 			TLS: []networkingV1.IngressTLS{{Hosts: []string{hostname}, SecretName: tlsSecret}},
@@ -199,7 +205,7 @@ func (k *k8sTest) CreateIngress(hostname string, tlsSecret string, ingressClass
 								PathType: &pathType,
 								Backend: networkingV1.IngressBackend{
 									Service: &networkingV1.IngressServiceBackend{
-										Name: "smoketest-svc",
+										Name: k.serviceName(),
 										Port: networkingV1.ServiceBackendPort{Number: 80},
 									},
 								},
@@ -230,7 +236,7 @@ func (k *k8sTest) CreateIngress(hostname string, tlsSecret string, ingressClass
 func (k *k8sTest) DeleteIngress(hostname string) error {
 	log.Println("Deleting k8s ingress")
 	ctx := context.Background()
-	if err := k.client.NetworkingV1().Ingresses(k.config.K8sNamespace).Delete(ctx, "smoketest-ingress-"+hostname, metav1.DeleteOptions{}); err != nil {
+	if err := k.client.NetworkingV1().Ingresses(k.config.K8sNamespace).Delete(ctx, k.ingressName(hostname), metav1.DeleteOptions{}); err != nil {
 		return fmt.Errorf("failed to delete ingress: %v", err)
 	}
 
@@ -247,11 +253,12 @@ func (k *k8sTest) CreateService() (interface{}, error) {
 			APIVersion: "v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "smoketest-svc",
+			Name:   k.serviceName(),
+			Labels: k.labels(nil),
 		},
 		Spec: corev1.ServiceSpec{
 			Ports:    []corev1.ServicePort{{Name: "http", Port: 80, Protocol: "TCP"}},
-			Selector: map[string]string{"app": "smoketest"},
+			Selector: map[string]string{"app": k.name},
 			Type:     "ClusterIP",
 		},
 	}
@@ -263,7 +270,7 @@ func (k *k8sTest) CreateService() (interface{}, error) {
 func (k *k8sTest) DeleteService() (interface{}, error) {
 	log.Println("Deleting k8s service")
 	ctx := context.Background()
-	if err := k.client.CoreV1().Services(k.config.K8sNamespace).Delete(ctx, "smoketest-svc", metav1.DeleteOptions{}); err != nil {
+	if err := k.client.CoreV1().Services(k.config.K8sNamespace).Delete(ctx, k.serviceName(), metav1.DeleteOptions{}); err != nil {
 		return nil, fmt.Errorf("failed to delete service: %v", err)
 	}
 
@@ -291,16 +298,12 @@ func (k *k8sTest) TestConnection(hostname string) error {
 	log.Println("Testing connection to deployment")
 	var status int
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	httpClient := &http.Client{Transport: tr}
-
 	for retries := 60; retries > 0 && status != 200; retries-- {
-		r, err := httpClient.Get("https://" + hostname)
+		r, err := k.httpClient.Get("https://" + hostname)
 		if err != nil {
 			return err
 		}
+		r.Body.Close()
 
 		status = r.StatusCode
 		time.Sleep(500 * time.Millisecond)
@@ -312,3 +315,99 @@ func (k *k8sTest) TestConnection(hostname string) error {
 
 	return nil
 }
+
+func (k *k8sTest) describe() (string, string) {
+	return k8sKey, k8sName
+}
+
+func (k *k8sTest) serviceName() string {
+	return k.name + "-svc"
+}
+
+func (k *k8sTest) ingressName(hostname string) string {
+	return k.name + "-ingress-" + hostname
+}
+
+// labels returns the given labels extended with the labels that identify objects created by the smoke tests.
+func (k *k8sTest) labels(labels map[string]string) map[string]string {
+	result := map[string]string{
+		smokeTestManagedByLabel: smokeTestManagedBy,
+		smokeTestCreatedLabel:   strconv.FormatInt(k.created.Unix(), 10),
+	}
+	for key, value := range labels {
+		result[key] = value
+	}
+	return result
+}
+
+// k8sCreatedBefore determines whether an object was created by the smoke tests before the given time.
+func k8sCreatedBefore(meta metav1.ObjectMeta, createdBefore time.Time) bool {
+	created := meta.CreationTimestamp.Time
+	if seconds, err := strconv.ParseInt(meta.Labels[smokeTestCreatedLabel], 10, 64); err == nil {
+		created = time.Unix(seconds, 0)
+	}
+	return created.Before(createdBefore)
+}
+
+// sweep deletes ingresses, services and deployments left behind by interrupted runs.
+func (k *k8sTest) sweep(createdBefore time.Time) ([]string, error) {
+	ctx := context.Background()
+	listOptions := metav1.ListOptions{LabelSelector: smokeTestManagedByLabel + "=" + smokeTestManagedBy}
+
+	var removed []string
+	var errs []error
+
+	ingresses, err := k.client.NetworkingV1().Ingresses(k.config.K8sNamespace).List(ctx, listOptions)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, ingress := range ingresses.Items {
+			if !k8sCreatedBefore(ingress.ObjectMeta, createdBefore) {
+				continue
+			}
+			if err := k.client.NetworkingV1().Ingresses(k.config.K8sNamespace).Delete(ctx, ingress.Name, metav1.DeleteOptions{}); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			removed = append(removed, "k8s ingress "+ingress.Name)
+		}
+	}
+
+	services, err := k.client.CoreV1().Services(k.config.K8sNamespace).List(ctx, listOptions)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, service := range services.Items {
+			if !k8sCreatedBefore(service.ObjectMeta, createdBefore) {
+				continue
+			}
+			if err := k.client.CoreV1().Services(k.config.K8sNamespace).Delete(ctx, service.Name, metav1.DeleteOptions{}); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			removed = append(removed, "k8s service "+service.Name)
+		}
+	}
+
+	deployments, err := k.client.AppsV1().Deployments(k.config.K8sNamespace).List(ctx, listOptions)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, deployment := range deployments.Items {
+			if !k8sCreatedBefore(deployment.ObjectMeta, createdBefore) {
+				continue
+			}
+			if err := k.client.AppsV1().Deployments(k.config.K8sNamespace).Delete(ctx, deployment.Name, metav1.DeleteOptions{}); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			removed = append(removed, "k8s deployment "+deployment.Name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("Failed to sweep k8s namespace %s: %v", k.config.K8sNamespace, errs)
+	}
+
+	return removed, nil
+}
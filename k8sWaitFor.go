@@ -146,7 +146,7 @@ func (k *k8sTest) WaitFor(ctx context.Context, client *kubernetes.Clientset, res
 				return nil
 			}
 		case Deployment:
-			deployment, err := client.AppsV1().Deployments(k.config.K8sNamespace).Get(ctx, "smoketest", metav1.GetOptions{})
+			deployment, err := client.AppsV1().Deployments(k.config.K8sNamespace).Get(ctx, k.name, metav1.GetOptions{})
 			if err != nil {
 				continue
 			}
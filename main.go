@@ -1,20 +1,29 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	cfenv "github.com/cloudfoundry-community/go-cfenv"
 )
 
 var program SmokeTestProgram
 
+// aggregator is only set when this instance aggregates the results of other sites.
+var aggregator *federation
+
+var config SmokeTestConfig
+
 func handlerStatus(w http.ResponseWriter, r *http.Request) {
 
-	// Run all tests.
-	results := program.run()
+	// Run all tests. While they run, the run can be followed through /v1/runs/current.
+	runID, results := program.run()
+	w.Header().Set("X-Run-Id", runID)
 
 	// Write output to response.
 	body, err := json.Marshal(results)
@@ -30,13 +39,235 @@ func handlerStatus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func handlerSweeper(w http.ResponseWriter, r *http.Request) {
+	var report SweepReport
+	if r.Method == http.MethodPost {
+		report = program.sweep()
+	} else {
+		report = program.lastSweep()
+	}
+
+	writeJSON(w, report)
+}
+
+func handlerFederationStatus(w http.ResponseWriter, r *http.Request) {
+	if aggregator == nil {
+		http.Error(w, "Federation is not configured", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, aggregator.status())
+}
+
+func handlerFederationDiff(w http.ResponseWriter, r *http.Request) {
+	if aggregator == nil {
+		http.Error(w, "Federation is not configured", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, aggregator.status().Diffs)
+}
+
+// handlerSLA serves availability reports. Query parameters: window (default: all configured windows), site,
+// key, format (json or csv) and report (summary or outages, csv only).
+func handlerSLA(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	windows := config.SLAWindows
+	if window := query.Get("window"); window != "" {
+		windows = []string{window}
+	}
+
+	var reports []AvailabilityReport
+	now := time.Now()
+	for _, windowName := range windows {
+		window, err := parseWindow(windowName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reports = append(reports, program.availability().report(window, windowName, query.Get("site"), query.Get("key"), now)...)
+	}
+
+	if query.Get("format") != "csv" {
+		writeJSON(w, reports)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	var err error
+	if query.Get("report") == "outages" {
+		err = writeOutagesCSV(w, reports)
+	} else {
+		err = writeAvailabilityCSV(w, reports)
+	}
+	if err != nil {
+		log.Printf("Unable to write availability report: %v", err)
+	}
+}
+
+// handlerMaintenance lists (GET) and declares (POST) maintenance windows.
+func handlerMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, program.maintenance().list())
+	case http.MethodPost:
+		var window MaintenanceWindow
+		if err := json.NewDecoder(r.Body).Decode(&window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		window, err := program.maintenance().add(window)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, window)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerMaintenanceWindow deletes a maintenance window.
+func handlerMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !program.maintenance().remove(strings.TrimPrefix(r.URL.Path, "/v1/maintenance/")) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerRuns starts a run in the background (POST) and returns its id. The run can be followed at
+// /v1/runs/{id}/events.
+func handlerRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	events := program.start()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/runs/"+events.id)
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]string{"id": events.id, "events": "/v1/runs/" + events.id + "/events"})
+}
+
+// handlerRun serves /v1/runs/{id} (the results of a finished run), /v1/runs/latest (the results of the most
+// recently finished run), /v1/runs/current (the id of the run that is executing, however it was started) and
+// /v1/runs/{id}/events (the progress of a run as Server-Sent Events).
+func handlerRun(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/runs/")
+
+	if path == "current" {
+		events, ok := program.current()
+		if !ok {
+			http.Error(w, "No run is executing", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]string{"id": events.id, "events": "/v1/runs/" + events.id + "/events"})
+		return
+	}
+
+	if path == "latest" {
+		run, ok := program.history().latest()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, run)
+		return
+	}
+
+	if id := strings.TrimSuffix(path, "/events"); id != path {
+		events, ok := program.events(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		serveEvents(w, r, events)
+		return
+	}
+
+	for _, run := range program.history().all() {
+		if run.ID == path {
+			writeJSON(w, run)
+			return
+		}
+	}
+	if _, ok := program.events(path); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, map[string]string{"id": path, "status": "running"})
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// handlerCanaries lists the state of the canaries (GET /v1/canaries) and bootstraps the canary of a test
+// (POST /v1/canaries/{key}), which lets the next run write it.
+func handlerCanaries(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/canaries"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		writeJSON(w, canaries.all())
+	case r.Method == http.MethodPost && key != "":
+		if !canaries.bootstrap(key) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// requireToken lets requests that change state (anything but GET and HEAD) through only when they carry
+// "Authorization: Bearer <ADMIN_TOKEN>". Without a configured token, such requests are refused altogether.
+func requireToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+
+		if config.AdminToken == "" {
+			http.Error(w, "ADMIN_TOKEN is not configured", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
 func main() {
 	appEnv, err := cfenv.Current()
 	if err != nil {
 		panic(err)
 	}
 
-	config, err := smokeTestsConfigLoad()
+	config, err = smokeTestsConfigLoad()
 	if err != nil {
 		panic(err)
 	}
@@ -44,6 +275,31 @@ func main() {
 	program = &smokeTestProgram{}
 	program.init(appEnv, config)
 
+	// Remove resources left behind by runs that were interrupted, e.g. because the app crashed.
+	go sweepPeriodically(program, config.SweepInterval)
+
+	aggregator, err = federationNew(config, program.availability(), program.maintenance())
+	if err != nil {
+		panic(err)
+	}
+	if aggregator != nil {
+		go aggregator.pollPeriodically(config.FederationInterval)
+	}
+
 	http.HandleFunc("/v1/status", handlerStatus)
+	http.HandleFunc("/v1/sweeper", requireToken(handlerSweeper))
+	http.HandleFunc("/v1/federation/status", handlerFederationStatus)
+	http.HandleFunc("/v1/federation/diff", handlerFederationDiff)
+	http.HandleFunc("/v1/history", handlerHistory)
+	http.HandleFunc("/v1/sla", handlerSLA)
+	http.HandleFunc("/v1/maintenance", requireToken(handlerMaintenance))
+	http.HandleFunc("/v1/maintenance/", requireToken(handlerMaintenanceWindow))
+	http.HandleFunc("/v1/runs", requireToken(handlerRuns))
+	http.HandleFunc("/v1/runs/", handlerRun)
+	http.HandleFunc("/v1/canaries", requireToken(handlerCanaries))
+	http.HandleFunc("/v1/canaries/", requireToken(handlerCanaries))
+	http.HandleFunc("/v1/badge/", handlerBadge)
+	http.HandleFunc("/metrics", handlerMetrics)
+	http.HandleFunc("/", handlerStatusPage)
 	http.ListenAndServe(fmt.Sprintf(":%v", appEnv.Port), nil)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaintenanceWindow silences a test (Key), all tests of a site (Site), or a test in a site (both) between
+// Start and End. Results produced inside the window are annotated with the reason, are not published to the
+// dashboard and do not count for availability.
+type MaintenanceWindow struct {
+	ID     string    `json:"id"`
+	Key    string    `json:"key,omitempty"`
+	Site   string    `json:"site,omitempty"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason"`
+}
+
+const maintenanceState = "maintenance"
+
+// maintenanceSchedule holds the declared maintenance windows. Windows are kept in the state store: the app
+// itself is restaged or moved during the platform upgrades they are declared for.
+type maintenanceSchedule struct {
+	mutex   sync.Mutex
+	store   *stateStore
+	nextID  int
+	windows []MaintenanceWindow
+}
+
+func maintenanceScheduleNew(store *stateStore) *maintenanceSchedule {
+	m := &maintenanceSchedule{store: store, nextID: 1}
+	if err := store.load(maintenanceState, &m.windows); err != nil {
+		log.Printf("Unable to load maintenance windows: %v", err)
+	}
+	for _, window := range m.windows {
+		if id, err := strconv.Atoi(window.ID); err == nil && id >= m.nextID {
+			m.nextID = id + 1
+		}
+	}
+	return m
+}
+
+func (m *maintenanceSchedule) add(window MaintenanceWindow) (MaintenanceWindow, error) {
+	if window.Start.IsZero() || window.End.IsZero() {
+		return MaintenanceWindow{}, fmt.Errorf("A maintenance window needs a start and an end")
+	}
+	if !window.End.After(window.Start) {
+		return MaintenanceWindow{}, fmt.Errorf("The end of a maintenance window must be after its start")
+	}
+	if window.Reason == "" {
+		return MaintenanceWindow{}, fmt.Errorf("A maintenance window needs a reason")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	window.ID = strconv.Itoa(m.nextID)
+	m.nextID++
+	m.windows = append(m.windows, window)
+	m.save()
+	return window, nil
+}
+
+func (m *maintenanceSchedule) remove(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, window := range m.windows {
+		if window.ID == id {
+			m.windows = append(m.windows[:i], m.windows[i+1:]...)
+			m.save()
+			return true
+		}
+	}
+	return false
+}
+
+func (m *maintenanceSchedule) save() {
+	if err := m.store.save(maintenanceState, m.windows); err != nil {
+		log.Printf("Unable to save maintenance windows: %v", err)
+	}
+}
+
+// list returns all windows ordered by start.
+func (m *maintenanceSchedule) list() []MaintenanceWindow {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	windows := make([]MaintenanceWindow, len(m.windows))
+	copy(windows, m.windows)
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+	return windows
+}
+
+// active returns the window that covers the test with the given key in the given site at the given time.
+func (m *maintenanceSchedule) active(site, key string, at time.Time) (MaintenanceWindow, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, window := range m.windows {
+		if (window.Site != "" && window.Site != site) || (window.Key != "" && window.Key != key) {
+			continue
+		}
+		if !at.Before(window.Start) && at.Before(window.End) {
+			return window, true
+		}
+	}
+	return MaintenanceWindow{}, false
+}
+
+// annotate marks the results that were produced inside a maintenance window.
+func (m *maintenanceSchedule) annotate(site string, at time.Time, results []SmokeTestResult) {
+	for i := range results {
+		if window, ok := m.active(site, results[i].Key, at); ok {
+			results[i].Maintenance = window.Reason
+		}
+	}
+}
+
+// withoutMaintenance returns the results that were not produced inside a maintenance window.
+func withoutMaintenance(results []SmokeTestResult) []SmokeTestResult {
+	filtered := make([]SmokeTestResult, 0, len(results))
+	for _, result := range results {
+		if result.Maintenance == "" {
+			filtered = append(filtered, result)
+		}
+	}
+	return filtered
+}
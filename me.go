@@ -10,11 +10,16 @@ func meTestNew() SmokeTest {
 }
 
 func (m *me) run() SmokeTestResult {
+	key, name := m.describe()
+	return SmokeTestResult{Key: key, Name: name, Result: true}
+}
+
+func (m *me) describe() (string, string) {
 	name := "Me"
 	sitetype := os.Getenv("TYPE")
 	sitename := os.Getenv("SITE")
 	if sitetype != "" && sitename != "" {
 		name = sitetype + "\n" + sitename
 	}
-	return SmokeTestResult{Key: "me", Name: name, Result: true}
+	return "me", name
 }
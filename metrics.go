@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// handlerMetrics serves the latest run in the Prometheus text format: the outcome, degradation and duration
+// of every test and step, and the metrics the steps report, such as connection headroom and round trip
+// times.
+func handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	run, found := program.history().latest()
+	if !found {
+		return
+	}
+	writeMetrics(w, run)
+}
+
+func writeMetrics(w io.Writer, run runRecord) {
+	gauge := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("smoketest_last_run_timestamp_seconds", "Time the latest run started.")
+	fmt.Fprintf(w, "smoketest_last_run_timestamp_seconds %d\n", run.Started.Unix())
+
+	gauge("smoketest_result", "Outcome of the test in the latest run: 1 passed, 0 failed.")
+	for _, test := range run.Results {
+		fmt.Fprintf(w, "smoketest_result%s %d\n", metricLabels("key", test.Key, "name", test.Name), metricBool(test.Result))
+	}
+	gauge("smoketest_degraded", "Whether the test passed with degraded steps in the latest run.")
+	for _, test := range run.Results {
+		fmt.Fprintf(w, "smoketest_degraded%s %d\n", metricLabels("key", test.Key), metricBool(test.Degraded))
+	}
+	gauge("smoketest_maintenance", "Whether the test ran inside a maintenance window in the latest run.")
+	for _, test := range run.Results {
+		fmt.Fprintf(w, "smoketest_maintenance%s %d\n", metricLabels("key", test.Key), metricBool(test.Maintenance != ""))
+	}
+	gauge("smoketest_duration_seconds", "Duration of the test in the latest run.")
+	for _, test := range run.Results {
+		fmt.Fprintf(w, "smoketest_duration_seconds%s %g\n", metricLabels("key", test.Key), float64(test.DurationMs)/1000)
+	}
+
+	gauge("smoketest_step_result", "Outcome of the step in the latest run: 1 passed, 0 failed or skipped.")
+	for _, test := range run.Results {
+		for _, step := range test.Results {
+			fmt.Fprintf(w, "smoketest_step_result%s %d\n", metricLabels("key", test.Key, "step", step.Name), metricBool(step.Result))
+		}
+	}
+	gauge("smoketest_step_metric", "Measurement reported by the step in the latest run.")
+	for _, test := range run.Results {
+		for _, step := range test.Results {
+			names := make([]string, 0, len(step.Metrics))
+			for name := range step.Metrics {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(w, "smoketest_step_metric%s %g\n", metricLabels("key", test.Key, "step", step.Name, "metric", name), step.Metrics[name])
+			}
+		}
+	}
+}
+
+// metricLabels formats name/value pairs as Prometheus labels.
+func metricLabels(pairs ...string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], escaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func metricBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricLabels(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs []string
+		want  string
+	}{
+		{name: "no labels", want: "{}"},
+		{name: "single label", pairs: []string{"key", "p.redis"}, want: `{key="p.redis"}`},
+		{name: "labels in order", pairs: []string{"key", "p.mysql", "step", "Open connection"}, want: `{key="p.mysql",step="Open connection"}`},
+		{name: "quotes", pairs: []string{"step", `Read "canary"`}, want: `{step="Read \"canary\""}`},
+		{name: "backslashes", pairs: []string{"step", `C:\share`}, want: `{step="C:\\share"}`},
+		{name: "newlines", pairs: []string{"step", "a\nb"}, want: `{step="a\nb"}`},
+		{name: "value without a name is dropped", pairs: []string{"key", "k", "step"}, want: `{key="k"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := metricLabels(tt.pairs...); got != tt.want {
+				t.Errorf("metricLabels(%q) = %s, want %s", tt.pairs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	run := runRecord{
+		Started: time.Unix(1697700000, 0),
+		Results: []SmokeTestResult{{
+			Key:        "p.redis",
+			Name:       "Redis",
+			Result:     true,
+			Degraded:   true,
+			DurationMs: 1500,
+			Results: []SmokeTestResult{
+				{Name: "Ping", Result: true, Metrics: map[string]float64{"roundTripMs": 2, "connections": 10}},
+				{Name: "Set key", Result: false},
+			},
+		}},
+	}
+
+	var out bytes.Buffer
+	writeMetrics(&out, run)
+
+	for _, want := range []string{
+		"smoketest_last_run_timestamp_seconds 1697700000\n",
+		`smoketest_result{key="p.redis",name="Redis"} 1` + "\n",
+		`smoketest_degraded{key="p.redis"} 1` + "\n",
+		`smoketest_maintenance{key="p.redis"} 0` + "\n",
+		`smoketest_duration_seconds{key="p.redis"} 1.5` + "\n",
+		`smoketest_step_result{key="p.redis",step="Ping"} 1` + "\n",
+		`smoketest_step_result{key="p.redis",step="Set key"} 0` + "\n",
+		`smoketest_step_metric{key="p.redis",step="Ping",metric="connections"} 10` + "\n" +
+			`smoketest_step_metric{key="p.redis",step="Ping",metric="roundTripMs"} 2` + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, out.String())
+		}
+	}
+}
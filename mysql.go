@@ -3,8 +3,9 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 
 	"github.com/cloudfoundry-community/go-cfenv"
 )
@@ -12,28 +13,19 @@ import (
 const (
 	mySQLKey  = "mySQL"
 	mySQLName = "MySQL"
-
-	mySQLTestBinding       = "Read service binding"
-	mySQLErrorBinding      = "No MySQL hostname found in VCAP_SERVICES"
-	mySQLTestConnection    = "Open connection"
-	mySQLTestPrepareCreate = "Prepare create table"
-	mySQLTestCreate        = "Create table"
-	mySQLTestPrepareInsert = "Prepare insert record"
-	mySQLTestInsert        = "Insert record"
-	mySQLTestSelect        = "Select records"
-	mySQLTestPrepareDelete = "Prepare delete record"
-	mySQLTestDelete        = "Delete record"
 )
 
-type mySQLTest struct {
-	hostname string
-	port     float64
-	dbname   string
-	username string
-	password string
+var mySQLDialect = &sqlDialect{
+	driver:            "mysql",
+	createTable:       "CREATE TABLE IF NOT EXISTS smoketests(name VARCHAR(64) NOT NULL, created BIGINT NOT NULL)",
+	createCanaryTable: "CREATE TABLE IF NOT EXISTS smoketests_canary(name VARCHAR(64) NOT NULL PRIMARY KEY, payload VARCHAR(255) NOT NULL)",
+	bind:              questionMarkBind,
+	connections:       mySQLConnections,
 }
 
-func mySQLTestNew(env *cfenv.App) SmokeTest {
+func mySQLTestNew(env *cfenv.App, config SmokeTestConfig) (test SmokeTest) {
+	defer recoverTestNew(&test, mySQLKey, mySQLName)
+
 	// TODO: replace with searching on tag basis, possibly resulting in multiple returns in case of multiple matches.
 	mySQLServices, err := env.Services.WithLabel("p.mySQL")
 	if err != nil {
@@ -41,105 +33,37 @@ func mySQLTestNew(env *cfenv.App) SmokeTest {
 	}
 
 	creds := mySQLServices[0].Credentials
-	return &mySQLTest{
-		hostname: creds["hostname"].(string),
-		port:     creds["port"].(float64),
-		dbname:   creds["name"].(string),
-		username: creds["username"].(string),
-		password: creds["password"].(string),
-	}
-
-}
-
-func (m *mySQLTest) run() SmokeTestResult {
-	results := make([]SmokeTestResult, 0)
-
-	// Check service binding.
-	fmt.Println("found mySQL hostname:" + m.hostname)
-	if m.hostname == "" {
-		fmt.Println("no mySQL uri found")
-		results = append(results, SmokeTestResult{Name: mySQLTestBinding, Result: false, Error: mySQLErrorBinding})
-		return OverallResult(mySQLKey, mySQLName, results)
-	}
-	results = append(results, SmokeTestResult{Name: mySQLTestBinding, Result: true})
-
-	// Open connection.
-	openConnection := func() (interface{}, error) {
-		return sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%.f)/%v?readTimeout=30s&writeTimeout=30s&timeout=30s", m.username, m.password, m.hostname, m.port, m.dbname))
-	}
-	obj, success := RunTestPart(openConnection, mySQLTestConnection, &results)
-	if !success {
-		return OverallResult(mySQLKey, mySQLName, results)
-	}
-	db := obj.(*sql.DB)
-	defer db.Close()
-
-	// Prepare create table.
-	prepareCreateTable := func() (interface{}, error) {
-		return db.Prepare("CREATE TABLE IF NOT EXISTS deepthought(theanswertoeverything INT)")
-	}
-	obj, success = RunTestPart(prepareCreateTable, mySQLTestPrepareCreate, &results)
-	if !success {
-		return OverallResult(mySQLKey, mySQLName, results)
-	}
-	createTableStmt := obj.(*sql.Stmt)
-	defer createTableStmt.Close()
+	hostname := creds["hostname"].(string)
+	dataSourceName := fmt.Sprintf("%s:%s@tcp(%s:%.f)/%v?readTimeout=30s&writeTimeout=30s&timeout=30s",
+		creds["username"].(string), creds["password"].(string), hostname, creds["port"].(float64), creds["name"].(string))
 
-	// Create table.
-	createTable := func() (interface{}, error) {
-		return createTableStmt.Exec()
-	}
-	_, success = RunTestPart(createTable, mySQLTestCreate, &results)
-	if !success {
-		return OverallResult(mySQLKey, mySQLName, results)
-	}
-
-	// Prepare insert.
-	prepareInsert := func() (interface{}, error) {
-		return db.Prepare("INSERT INTO deepthought(theanswertoeverything) VALUES(?)")
-	}
-	obj, success = RunTestPart(prepareInsert, mySQLTestPrepareInsert, &results)
-	if !success {
-		return OverallResult(mySQLKey, mySQLName, results)
-	}
-	insertStmt := obj.(*sql.Stmt)
-	defer insertStmt.Close()
-
-	// Insert.
-	insert := func() (interface{}, error) {
-		return insertStmt.Exec(42)
+	checks := mySQLClusterChecks(config)
+	tlsConfig, tlsChecks, err := sqlTLSConfig(config, creds, hostname)
+	if err != nil {
+		panic(err)
 	}
-	_, success = RunTestPart(insert, mySQLTestInsert, &results)
-	if !success {
-		return OverallResult(mySQLKey, mySQLName, results)
+	if tlsConfig != nil {
+		if err := mysql.RegisterTLSConfig(mySQLKey, tlsConfig); err != nil {
+			panic(err)
+		}
+		dataSourceName += "&tls=" + mySQLKey
+		checks = append(tlsChecks, checks...)
 	}
 
-	// Select.
-	query := func() (interface{}, error) {
-		return db.Query("SELECT * FROM deepthought WHERE theanswertoeverything = 42")
-	}
-	_, success = RunTestPart(query, mySQLTestSelect, &results)
-	if !success {
-		return OverallResult(mySQLKey, mySQLName, results)
-	}
+	return sqlTestNew(config, mySQLKey, mySQLName, mySQLDialect, hostname, dataSourceName, checks...)
+}
 
-	// Prepare delete.
-	prepareDelete := func() (interface{}, error) {
-		return db.Prepare("DELETE FROM deepthought WHERE theanswertoeverything = ?")
+func mySQLConnections(db *sql.DB) (used, max int, err error) {
+	if err := db.QueryRow("SELECT @@global.max_connections").Scan(&max); err != nil {
+		return 0, 0, err
 	}
-	obj, success = RunTestPart(prepareDelete, mySQLTestPrepareDelete, &results)
-	if !success {
-		return OverallResult(mySQLKey, mySQLName, results)
+	status, err := sqlVariables(db, "SHOW GLOBAL STATUS LIKE 'Threads_connected'")
+	if err != nil {
+		return 0, 0, err
 	}
-	deleteStmt := obj.(*sql.Stmt)
-	defer deleteStmt.Close()
-
-	// Delete.
-	delete := func() (interface{}, error) {
-		return deleteStmt.Exec("42")
+	used, err = strconv.Atoi(status["Threads_connected"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid Threads_connected %q", status["Threads_connected"])
 	}
-	_, _ = RunTestPart(delete, mySQLTestDelete, &results)
-
-	// Determine overall result and return.
-	return OverallResult(mySQLKey, mySQLName, results)
+	return used, max, nil
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	mySQLClusterGalera         = "galera"
+	mySQLClusterLeaderFollower = "leader-follower"
+
+	mySQLTestGalera      = "Galera cluster health"
+	mySQLTestReplication = "Replication health"
+
+	// Server errors for an unknown statement and for statements and tables the user has no access to.
+	mySQLErrorParse                = 1064
+	mySQLErrorSpecificAccessDenied = 1227
+	mySQLErrorTableAccessDenied    = 1142
+)
+
+// mySQLClusterChecks returns the checks of the cluster behind the MySQL service, as configured by
+// MYSQL_CLUSTER. MYSQL_CLUSTER_SIZE defaults to the size of the plans: 3 nodes for Galera, a leader and a
+// follower for leader-follower.
+func mySQLClusterChecks(config SmokeTestConfig) []sqlCheck {
+	size := config.MySQLClusterSize
+	switch strings.ToLower(config.MySQLCluster) {
+	case "":
+		return nil
+	case mySQLClusterGalera:
+		if size == 0 {
+			size = 3
+		}
+		return []sqlCheck{{name: mySQLTestGalera, run: func(run *sqlRun, result *SmokeTestResult) error {
+			return mySQLGaleraCheck(run.db, size)
+		}}}
+	case mySQLClusterLeaderFollower:
+		if size == 0 {
+			size = 2
+		}
+		return []sqlCheck{{name: mySQLTestReplication, run: func(run *sqlRun, result *SmokeTestResult) error {
+			return mySQLReplicationCheck(run.db, size, config.MySQLMaxReplicationLag)
+		}}}
+	default:
+		panic(fmt.Sprintf("Unknown MYSQL_CLUSTER %q, expected %q or %q", config.MySQLCluster, mySQLClusterGalera, mySQLClusterLeaderFollower))
+	}
+}
+
+// mySQLGaleraCheck checks the Galera cluster through the node the proxy routed us to. The check fails when
+// the node can't serve queries or the cluster lost quorum, and is degraded when nodes are missing or the node
+// is not Synced.
+func mySQLGaleraCheck(db *sql.DB, expectedSize int) error {
+	status, err := sqlVariables(db, "SHOW GLOBAL STATUS LIKE 'wsrep_%'")
+	if err != nil {
+		return err
+	}
+	if len(status) == 0 {
+		return fmt.Errorf("No wsrep status found: MySQL is not a Galera cluster")
+	}
+
+	if ready := status["wsrep_ready"]; ready != "ON" {
+		return fmt.Errorf("wsrep_ready is %q", ready)
+	}
+	if clusterStatus := status["wsrep_cluster_status"]; clusterStatus != "" && clusterStatus != "Primary" {
+		return fmt.Errorf("wsrep_cluster_status is %q: the cluster lost quorum", clusterStatus)
+	}
+
+	size, err := strconv.Atoi(status["wsrep_cluster_size"])
+	if err != nil {
+		return fmt.Errorf("Invalid wsrep_cluster_size %q", status["wsrep_cluster_size"])
+	}
+	if size*2 <= expectedSize {
+		return fmt.Errorf("wsrep_cluster_size is %d, expected %d", size, expectedSize)
+	}
+
+	var problems []string
+	if size < expectedSize {
+		problems = append(problems, fmt.Sprintf("wsrep_cluster_size is %d, expected %d", size, expectedSize))
+	}
+	if state := status["wsrep_local_state_comment"]; state != "Synced" {
+		problems = append(problems, fmt.Sprintf("node is %s, not Synced", state))
+	}
+	if len(problems) > 0 {
+		return degraded("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// mySQLReplicationCheck checks a leader-follower cluster. Connected to a follower, it checks that both
+// replication threads run and the follower keeps up. Connected to the leader, it checks that the leader is
+// writable and that the expected number of followers is attached. Binding users usually lack the privileges
+// to see replication, which degrades the check instead of failing it.
+func mySQLReplicationCheck(db *sql.DB, expectedSize int, maxLag time.Duration) error {
+	// MySQL 8.0.22 renamed the statements and columns; 8.4 removed the old ones.
+	replica, isFollower, err := sqlRow(db, "SHOW REPLICA STATUS")
+	if mySQLErrorNumber(err) == mySQLErrorParse {
+		replica, isFollower, err = sqlRow(db, "SHOW SLAVE STATUS")
+	}
+	if mySQLAccessDenied(err) {
+		return degraded("Replication status not visible to the binding user (%v): it requires the REPLICATION CLIENT privilege", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if isFollower {
+		ioRunning := mySQLColumn(replica, "Replica_IO_Running", "Slave_IO_Running")
+		sqlRunning := mySQLColumn(replica, "Replica_SQL_Running", "Slave_SQL_Running")
+		if ioRunning != "Yes" || sqlRunning != "Yes" {
+			return fmt.Errorf("Replication stopped: IO thread %q, SQL thread %q: %s%s", ioRunning, sqlRunning, replica["Last_IO_Error"], replica["Last_SQL_Error"])
+		}
+		behind := mySQLColumn(replica, "Seconds_Behind_Source", "Seconds_Behind_Master")
+		lag, err := strconv.Atoi(behind)
+		if err != nil {
+			return fmt.Errorf("Replication lag unknown (seconds behind the leader %q)", behind)
+		}
+		if time.Duration(lag)*time.Second > maxLag {
+			return degraded("Follower is %ds behind the leader, more than %v", lag, maxLag)
+		}
+		return nil
+	}
+
+	var readOnly bool
+	if err := db.QueryRow("SELECT @@global.read_only").Scan(&readOnly); err != nil {
+		return err
+	}
+	if readOnly {
+		return fmt.Errorf("Leader is read-only")
+	}
+
+	followers, err := mySQLFollowers(db)
+	if mySQLAccessDenied(err) {
+		return degraded("Followers not visible to the binding user (%v): counting them requires the PROCESS or REPLICATION SLAVE privilege", err)
+	}
+	if err != nil {
+		return err
+	}
+	if followers < expectedSize-1 {
+		return degraded("%d follower(s) attached to the leader, expected %d", followers, expectedSize-1)
+	}
+	return nil
+}
+
+// mySQLFollowers counts the followers attached to the leader. Every follower has a binlog dump thread, but
+// other users' threads are only visible with the PROCESS privilege. Without it, the followers are listed
+// through SHOW REPLICAS, which leaves out followers that don't set report_host.
+func mySQLFollowers(db *sql.DB) (int, error) {
+	var process bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM information_schema.USER_PRIVILEGES WHERE PRIVILEGE_TYPE = 'PROCESS'").Scan(&process)
+	if err != nil {
+		return 0, err
+	}
+	if process {
+		var followers int
+		err := db.QueryRow("SELECT COUNT(*) FROM information_schema.PROCESSLIST WHERE COMMAND LIKE 'Binlog Dump%'").Scan(&followers)
+		return followers, err
+	}
+
+	rows, err := db.Query("SHOW REPLICAS")
+	if mySQLErrorNumber(err) == mySQLErrorParse {
+		rows, err = db.Query("SHOW SLAVE HOSTS")
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	followers := 0
+	for rows.Next() {
+		followers++
+	}
+	return followers, rows.Err()
+}
+
+// mySQLErrorNumber returns the number of a MySQL server error, or 0 for other errors.
+func mySQLErrorNumber(err error) uint16 {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number
+	}
+	return 0
+}
+
+func mySQLAccessDenied(err error) bool {
+	number := mySQLErrorNumber(err)
+	return number == mySQLErrorSpecificAccessDenied || number == mySQLErrorTableAccessDenied
+}
+
+// mySQLColumn returns the first of the columns present in the row, for columns renamed between versions.
+func mySQLColumn(row map[string]string, columns ...string) string {
+	for _, column := range columns {
+		if value, found := row[column]; found {
+			return value
+		}
+	}
+	return ""
+}
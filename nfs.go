@@ -8,11 +8,18 @@ import (
 	cfenv "github.com/cloudfoundry-community/go-cfenv"
 )
 
+const (
+	nfsKey  = "nfs"
+	nfsName = "NFS"
+)
+
 type nfsTest struct {
 	path string
 }
 
-func nfsTestNew(env *cfenv.App) SmokeTest {
+func nfsTestNew(env *cfenv.App) (test SmokeTest) {
+	defer recoverTestNew(&test, nfsKey, nfsName)
+
 	// TODO: replace with searching on tag basis, possibly resulting in multiple returns in case of multiple matches.
 	nfsServices, err := env.Services.WithTag("nfs")
 	if err != nil {
@@ -31,7 +38,7 @@ func (n *nfsTest) run() SmokeTestResult {
 
 	if n.path == "" {
 		results = append(results, SmokeTestResult{Name: "Load NFS Config", Result: false, Error: "NFS not configured"})
-		return OverallResult("nfs", "NFS", results)
+		return OverallResult(nfsKey, nfsName, results)
 	}
 
 	write := func() (interface{}, error) {
@@ -46,5 +53,9 @@ func (n *nfsTest) run() SmokeTestResult {
 	}
 
 	RunTestPart(write, "Write", &results)
-	return OverallResult("nfs", "NFS", results)
+	return OverallResult(nfsKey, nfsName, results)
+}
+
+func (n *nfsTest) describe() (string, string) {
+	return nfsKey, nfsName
 }
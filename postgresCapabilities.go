@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	postgresTestVersion    = "Server version"
+	postgresTestExtensions = "Required extensions"
+)
+
+// postgresCapabilityChecks returns the checks of the server version against POSTGRES_MIN_VERSION and of the
+// extensions in POSTGRES_REQUIRED_EXTENSIONS.
+func postgresCapabilityChecks(config SmokeTestConfig) ([]sqlCheck, error) {
+	minVersion := 0
+	if config.PostgresMinVersion != "" {
+		var err error
+		if minVersion, err = postgresVersionNum(config.PostgresMinVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	checks := []sqlCheck{{name: postgresTestVersion, run: func(run *sqlRun, result *SmokeTestResult) error {
+		return postgresVersionCheck(run, result, config.PostgresMinVersion, minVersion)
+	}}}
+
+	if len(config.PostgresRequiredExtensions) > 0 {
+		extensions := config.PostgresRequiredExtensions
+		checks = append(checks, sqlCheck{name: postgresTestExtensions, run: func(run *sqlRun, result *SmokeTestResult) error {
+			return postgresExtensionsCheck(run, result, extensions)
+		}})
+	}
+	return checks, nil
+}
+
+// postgresVersionNum converts a version like "12.5" or "9.6.3" to the format of server_version_num.
+func postgresVersionNum(version string) (int, error) {
+	parts := strings.Split(version, ".")
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || i >= len(numbers) {
+			return 0, fmt.Errorf("Invalid Postgres version %q", version)
+		}
+		numbers[i] = n
+	}
+
+	// Since Postgres 10 the version has two parts.
+	if numbers[0] >= 10 {
+		return numbers[0]*10000 + numbers[1], nil
+	}
+	return numbers[0]*10000 + numbers[1]*100 + numbers[2], nil
+}
+
+func postgresVersionCheck(run *sqlRun, result *SmokeTestResult, minVersion string, minVersionNum int) error {
+	var version string
+	var versionNum int
+	if err := run.db.QueryRow("SELECT current_setting('server_version'), current_setting('server_version_num')::int").Scan(&version, &versionNum); err != nil {
+		return err
+	}
+
+	result.Details = "Postgres " + version
+	if versionNum < minVersionNum {
+		return fmt.Errorf("Postgres %s is older than the required %s", version, minVersion)
+	}
+	return nil
+}
+
+// postgresExtensionsCheck creates the extensions in a transaction that is rolled back, so nothing is left
+// behind. Each extension gets its own savepoint, so all missing extensions are reported at once.
+func postgresExtensionsCheck(run *sqlRun, result *SmokeTestResult, extensions []string) error {
+	tx, err := run.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var installable, missing []string
+	for _, extension := range extensions {
+		if _, err := tx.Exec("SAVEPOINT extension"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("CREATE EXTENSION IF NOT EXISTS " + pgx.Identifier{extension}.Sanitize()); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (%v)", extension, err))
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT extension"); err != nil {
+				return err
+			}
+			continue
+		}
+		installable = append(installable, extension)
+	}
+
+	result.Details = "Installable: " + strings.Join(installable, ", ")
+	if len(missing) > 0 {
+		return fmt.Errorf("Unable to create extension(s): %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const postgresTestNotify = "LISTEN/NOTIFY round trip"
+
+// postgresNotifyCheck listens on a channel unique to the run with a native pgx connection, notifies it from a
+// second connection and verifies that the payload arrives within the timeout.
+func postgresNotifyCheck(connConfig *pgx.ConnConfig, timeout time.Duration) sqlCheck {
+	return sqlCheck{name: postgresTestNotify, run: func(run *sqlRun, result *SmokeTestResult) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout+30*time.Second)
+		defer cancel()
+
+		channel := fmt.Sprintf("smoketest_%d_%09d", run.created.Unix(), run.created.Nanosecond())
+
+		listener, err := pgx.ConnectConfig(ctx, connConfig)
+		if err != nil {
+			return fmt.Errorf("Unable to connect listener: %v", err)
+		}
+		defer listener.Close(context.Background())
+		if _, err := listener.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return err
+		}
+
+		notifier, err := pgx.ConnectConfig(ctx, connConfig)
+		if err != nil {
+			return fmt.Errorf("Unable to connect notifier: %v", err)
+		}
+		defer notifier.Close(context.Background())
+
+		sent := time.Now()
+		if _, err := notifier.Exec(ctx, "SELECT pg_notify($1, $2)", channel, run.record); err != nil {
+			return err
+		}
+
+		waitCtx, cancelWait := context.WithTimeout(ctx, timeout)
+		defer cancelWait()
+		notification, err := listener.WaitForNotification(waitCtx)
+		if err != nil {
+			return fmt.Errorf("No notification received within %v: %v", timeout, err)
+		}
+		if notification.Channel != channel || notification.Payload != run.record {
+			return fmt.Errorf("Unexpected notification on channel %s with payload %q", notification.Channel, notification.Payload)
+		}
+
+		result.Details = fmt.Sprintf("Notification received after %v", time.Since(sent).Round(time.Millisecond))
+		return nil
+	}}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	postgresTestStandbys    = "Connect to standbys"
+	postgresTestReplication = "Replication lag"
+	postgresTestVisibility  = "Record visible on standbys"
+)
+
+var errNotInRecovery = errors.New("not in recovery")
+
+// postgresReplication checks the standbys of an HA Postgres service: that they are in recovery, stream from
+// the primary without falling behind, and serve what was just written to the primary.
+type postgresReplication struct {
+	hosts             []*pgx.ConnConfig
+	maxLag            time.Duration
+	visibilityTimeout time.Duration
+
+	// The standbys that could be reached in the current run.
+	standbys []*pgx.ConnConfig
+}
+
+// postgresReplicationChecks returns the replication checks for the standbys in the binding: the hosts in
+// "hosts" other than the primary, or the endpoint in "read_only_uri". Standbys are connected to with the
+// credentials and TLS configuration of the primary.
+func postgresReplicationChecks(config SmokeTestConfig, creds map[string]interface{}, primary string, uri string, tlsConfig *tls.Config) ([]sqlCheck, error) {
+	var hosts []*pgx.ConnConfig
+
+	hostList, _ := creds["hosts"].([]interface{})
+	for _, h := range hostList {
+		host, _ := h.(string)
+		if host == "" || host == primary {
+			continue
+		}
+		connConfig, err := postgresStandbyConfig(uri, host, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, connConfig)
+	}
+
+	if readOnlyURI, _ := creds["read_only_uri"].(string); readOnlyURI != "" {
+		connConfig, err := postgresStandbyConfig(readOnlyURI, "", tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, connConfig)
+	}
+
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+
+	r := &postgresReplication{hosts: hosts, maxLag: config.PostgresMaxReplicationLag, visibilityTimeout: config.PostgresVisibilityTimeout}
+	return []sqlCheck{
+		{name: postgresTestStandbys, run: r.checkStandbys},
+		{name: postgresTestReplication, dependsOn: []string{postgresTestStandbys}, run: r.checkLag},
+		{name: postgresTestVisibility, dependsOn: []string{postgresTestStandbys, sqlTestInsert}, run: r.checkVisibility},
+	}, nil
+}
+
+// postgresStandbyConfig returns the connection configuration of a standby. An empty host keeps the host of
+// the URI; a host may include a port.
+func postgresStandbyConfig(uri, host string, tlsConfig *tls.Config) (*pgx.ConnConfig, error) {
+	connConfig, err := pgx.ParseConfig(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if host != "" {
+		connConfig.Host = host
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			port, err := strconv.ParseUint(p, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid port in standby host %s", host)
+			}
+			connConfig.Host, connConfig.Port = h, uint16(port)
+		}
+	}
+	connConfig.ConnectTimeout = 10 * time.Second
+
+	if tlsConfig != nil {
+		// Standby connections are not reported on by the TLS check of the primary.
+		standbyTLS := tlsConfig.Clone()
+		standbyTLS.ServerName = connConfig.Host
+		standbyTLS.VerifyConnection = nil
+		connConfig.TLSConfig = standbyTLS
+		connConfig.Fallbacks = nil
+	} else if connConfig.TLSConfig != nil {
+		connConfig.TLSConfig.ServerName = connConfig.Host
+		for _, fallback := range connConfig.Fallbacks {
+			fallback.Host = connConfig.Host
+			fallback.Port = connConfig.Port
+		}
+	}
+	return connConfig, nil
+}
+
+// withStandby connects to a standby for the duration of f.
+func withStandby(connConfig *pgx.ConnConfig, f func(ctx context.Context, conn *pgx.Conn) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	conn, err := pgx.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	return f(ctx, conn)
+}
+
+// checkStandbys connects to every standby and verifies that it is in recovery. The check is degraded when
+// some standbys can't be reached, and fails when none can or when a standby accepts writes.
+func (r *postgresReplication) checkStandbys(run *sqlRun, result *SmokeTestResult) error {
+	r.standbys = nil
+
+	var unreachable []string
+	for _, connConfig := range r.hosts {
+		err := withStandby(connConfig, func(ctx context.Context, conn *pgx.Conn) error {
+			var inRecovery bool
+			if err := conn.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+				return err
+			}
+			if !inRecovery {
+				return errNotInRecovery
+			}
+			return nil
+		})
+		if errors.Is(err, errNotInRecovery) {
+			return fmt.Errorf("Standby %s is not in recovery: there may be more than one primary", connConfig.Host)
+		}
+		if err != nil {
+			unreachable = append(unreachable, fmt.Sprintf("%s: %v", connConfig.Host, err))
+			continue
+		}
+		r.standbys = append(r.standbys, connConfig)
+	}
+
+	result.Details = fmt.Sprintf("%d of %d standby(s) in recovery", len(r.standbys), len(r.hosts))
+	if len(r.standbys) == 0 {
+		return fmt.Errorf("No standby reachable: %s", strings.Join(unreachable, "; "))
+	}
+	if len(unreachable) > 0 {
+		return degraded("Standby(s) unreachable: %s", strings.Join(unreachable, "; "))
+	}
+	return nil
+}
+
+// checkLag measures on every reachable standby how far replay is behind. A standby that has replayed all
+// WAL it received is caught up, however old its last replayed transaction is. The lag of a standby that
+// hasn't replayed any transaction since it started can't be measured there; for those, pg_stat_replication
+// on the primary is used, but only when its lag columns are readable, which requires pg_monitor.
+func (r *postgresReplication) checkLag(run *sqlRun, result *SmokeTestResult) error {
+	var worst time.Duration
+	var problems, unmeasured []string
+	for _, connConfig := range r.standbys {
+		var streaming, caughtUp bool
+		var lag *float64
+		err := withStandby(connConfig, func(ctx context.Context, conn *pgx.Conn) error {
+			return conn.QueryRow(ctx, `SELECT pg_last_wal_receive_lsn() IS NOT NULL,
+				COALESCE(pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn(), false),
+				EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())`).Scan(&streaming, &caughtUp, &lag)
+		})
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", connConfig.Host, err))
+		case !streaming:
+			problems = append(problems, fmt.Sprintf("%s is not streaming from the primary", connConfig.Host))
+		case caughtUp:
+			problems = r.lagProblem(problems, connConfig.Host, 0, &worst)
+		case lag == nil:
+			unmeasured = append(unmeasured, connConfig.Host)
+		default:
+			problems = r.lagProblem(problems, connConfig.Host, *lag, &worst)
+		}
+	}
+
+	if len(unmeasured) > 0 {
+		var err error
+		if problems, err = r.primaryLag(run, problems, unmeasured, &worst); err != nil {
+			return err
+		}
+	}
+
+	result.Details = fmt.Sprintf("%d standby(s), replay lag up to %.1fs", len(r.standbys), worst.Seconds())
+	if len(problems) > 0 {
+		return degraded("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// lagProblem keeps track of the worst lag and adds a problem when the lag exceeds the maximum.
+func (r *postgresReplication) lagProblem(problems []string, standby string, lag float64, worst *time.Duration) []string {
+	duration := time.Duration(lag * float64(time.Second))
+	if duration > *worst {
+		*worst = duration
+	}
+	if duration > r.maxLag {
+		problems = append(problems, fmt.Sprintf("%s replays %.1fs behind", standby, lag))
+	}
+	return problems
+}
+
+// primaryLag falls back to pg_stat_replication on the primary for standbys of which the lag couldn't be
+// measured. Without pg_monitor, the state and lag columns are hidden (NULL), and the lag remains unknown.
+func (r *postgresReplication) primaryLag(run *sqlRun, problems, unmeasured []string, worst *time.Duration) ([]string, error) {
+	rows, err := run.db.Query("SELECT COALESCE(application_name, ''), state, EXTRACT(EPOCH FROM replay_lag) FROM pg_stat_replication")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readable := false
+	for rows.Next() {
+		var name string
+		var state sql.NullString
+		var lag sql.NullFloat64
+		if err := rows.Scan(&name, &state, &lag); err != nil {
+			return nil, err
+		}
+		if !state.Valid {
+			continue
+		}
+		readable = true
+		// replay_lag is NULL when the standby is idle and caught up.
+		problems = r.lagProblem(problems, name, lag.Float64, worst)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if !readable {
+		problems = append(problems, fmt.Sprintf("Replay lag of %s unknown: no transaction replayed yet, and pg_stat_replication is not readable without pg_monitor", strings.Join(unmeasured, ", ")))
+	}
+	return problems, nil
+}
+
+// checkVisibility polls every reachable standby until the record inserted on the primary shows up, and fails
+// when it doesn't within the visibility timeout.
+func (r *postgresReplication) checkVisibility(run *sqlRun, result *SmokeTestResult) error {
+	started := time.Now()
+	var slowest time.Duration
+
+	for _, connConfig := range r.standbys {
+		err := withStandby(connConfig, func(ctx context.Context, conn *pgx.Conn) error {
+			for {
+				var count int
+				if err := conn.QueryRow(ctx, "SELECT count(*) FROM smoketests WHERE name = $1", run.record).Scan(&count); err != nil {
+					return err
+				}
+				if count > 0 {
+					return nil
+				}
+				if time.Since(started) > r.visibilityTimeout {
+					return fmt.Errorf("record not visible after %v", r.visibilityTimeout)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("Standby %s: %v", connConfig.Host, err)
+		}
+		if visible := time.Since(started); visible > slowest {
+			slowest = visible
+		}
+	}
+
+	result.Details = fmt.Sprintf("Visible on %d standby(s) within %v", len(r.standbys), slowest.Round(time.Millisecond))
+	return nil
+}
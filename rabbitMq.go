@@ -1,141 +1,268 @@
 package main
 
 import (
-        "crypto/tls"
-        "fmt"
-        "time"
+	"crypto/tls"
+	"fmt"
+	"time"
 
-        "github.com/cloudfoundry-community/go-cfenv"
-        "github.com/streadway/amqp"
+	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/streadway/amqp"
 )
 
 const (
-        rabbitMqKey  = "rabbitmq"
-        rabbitMqName = "RabbitMQ"
-
-        rabbitMqTestCreatePublishingChannel = "Create publishing channel"
-        rabbitMqTestDeclareQueue            = "Declare queue"
-        rabbitMqTestPublishMessage          = "Publish message"
-        rabbitMqTestCreateListeningChannel  = "Create listening channel"
-        rabbitMqTestConsumeMessage          = "Consume message"
-        rabbitMqTestCheckMessage            = "Check message"
+	rabbitMqKey  = "rabbitmq"
+	rabbitMqName = "RabbitMQ"
+
+	rabbitMqTestOpenConnection          = "Open connection"
+	rabbitMqTestCreatePublishingChannel = "Create publishing channel"
+	rabbitMqTestDeclareQueue            = "Declare queue"
+	rabbitMqTestPublishMessage          = "Publish message"
+	rabbitMqTestCreateListeningChannel  = "Create listening channel"
+	rabbitMqTestConsumeMessage          = "Consume message"
+	rabbitMqTestCheckMessage            = "Check message"
+	rabbitMqTestCloseConnection         = "Close connection"
 )
 
+// rabbitMqTest connects to RabbitMQ in every run, so a broker that was unavailable at startup or dropped the
+// connection is tested again in the next run.
 type rabbitMqTest struct {
-        connection *amqp.Connection
-        qname      string
-	rabbitMqKey string
+	uri       string
+	tlsConfig *tls.Config
+	// Queues are named per run and expire on the broker when a run is interrupted.
+	queueExpiry time.Duration
+	// timeout bounds the wait for the broker to confirm a message and for the message to be delivered.
+	timeout time.Duration
+	// queueTypes are the additional queue types to test, e.g. quorum and stream.
+	queueTypes []string
+	management *rabbitMqManagement
+	// isolationVhost is a vhost the credentials of the binding must not have access to.
+	isolationVhost string
+	// mqtt and stomp are the endpoints of these protocols in the binding, if any. An invalid endpoint is
+	// reported by the steps of the protocol.
+	mqtt         *rabbitMqEndpoint
+	mqttErr      error
+	stomp        *rabbitMqEndpoint
+	stompErr     error
+	rabbitMqKey  string
 	rabbitMqName string
 }
 
-func rabbitMqTestNew(env *cfenv.App, serviceName, friendlyName string) SmokeTest {
-        // TODO: replace with searching on tag basis, possibly resulting in multiple returns in case of multiple matches.
-        //rabbitMqServices, err := env.Services.WithLabel("p-rabbitmq")
-        rabbitMqServices, err := env.Services.WithLabel(serviceName)
-        if err != nil {
-                fmt.Println("RabbitMQ service not bound to smoketest app.")
-                return nil
-        }
-
-        uri := rabbitMqServices[0].Credentials["uri"].(string)
-
-        amqpConnection, err := amqp.DialTLS(uri, &tls.Config{InsecureSkipVerify: true})
-        if err != nil {
-                fmt.Println("Error connecting to rabbitMQ: " + err.Error())
-                return nil
-        }
-
-        return &rabbitMqTest{
-                connection: amqpConnection,
-                qname:      "smoketestsQueue",
-		rabbitMqKey: serviceName,
-		rabbitMqName: friendlyName,
-        }
+func rabbitMqTestNew(env *cfenv.App, config SmokeTestConfig, serviceName, friendlyName string) (test SmokeTest) {
+	defer recoverTestNew(&test, serviceName, friendlyName)
+
+	// TODO: replace with searching on tag basis, possibly resulting in multiple returns in case of multiple matches.
+	//rabbitMqServices, err := env.Services.WithLabel("p-rabbitmq")
+	rabbitMqServices, err := env.Services.WithLabel(serviceName)
+	if err != nil {
+		fmt.Println("RabbitMQ service not bound to smoketest app.")
+		return nil
+	}
+
+	for _, queueType := range config.RabbitMqQueueTypes {
+		if queueType != rabbitMqQueueTypeQuorum && queueType != rabbitMqQueueTypeStream {
+			panic(fmt.Sprintf("Unknown RABBITMQ_QUEUE_TYPES %q, expected %q or %q", queueType, rabbitMqQueueTypeQuorum, rabbitMqQueueTypeStream))
+		}
+	}
+
+	creds := rabbitMqServices[0].Credentials
+	tlsConfig, err := newTLSConfig(config, bindingCACert(creds))
+	if err != nil {
+		panic(fmt.Sprintf("Error loading CA certificates for rabbitMQ: %v", err))
+	}
+
+	management, err := rabbitMqManagementNew(config, creds)
+	if err != nil {
+		panic(err)
+	}
+
+	mqtt, mqttErr := rabbitMqEndpointNew(creds, "mqtt")
+	stomp, stompErr := rabbitMqEndpointNew(creds, "stomp")
+
+	return &rabbitMqTest{
+		uri:            creds["uri"].(string),
+		tlsConfig:      tlsConfig,
+		queueExpiry:    config.SweepTTL,
+		timeout:        config.RabbitMqTimeout,
+		queueTypes:     config.RabbitMqQueueTypes,
+		management:     management,
+		isolationVhost: config.RabbitMqIsolationVhost,
+		mqtt:           mqtt,
+		mqttErr:        mqttErr,
+		stomp:          stomp,
+		stompErr:       stompErr,
+		rabbitMqKey:    serviceName,
+		rabbitMqName:   friendlyName,
+	}
 }
 
-func (r *rabbitMqTest) listen(received chan SmokeTestResult, message string) {
-        ch, err := r.connection.Channel()
-        if err != nil {
-                fmt.Println("error opening listener channel: " + err.Error())
-                received <- SmokeTestResult{Name: rabbitMqTestCreateListeningChannel, Result: false, Error: err.Error()}
-                close(received)
-                return
-        }
-        defer ch.Close()
-        received <- SmokeTestResult{Name: rabbitMqTestCreateListeningChannel, Result: true}
-
-        msgs, err := ch.Consume(r.qname, "", true, false, false, false, nil)
-        if err != nil {
-                fmt.Println("error consuming messages: " + err.Error())
-                received <- SmokeTestResult{Name: rabbitMqTestConsumeMessage, Result: false, Error: err.Error()}
-                close(received)
-                return
-        }
-        received <- SmokeTestResult{Name: rabbitMqTestConsumeMessage, Result: true}
-
-        fmt.Println("Listener started...")
-        for msg := range msgs {
-                fmt.Printf("message: %s\n", msg.Body)
-                if fmt.Sprintf("%s", msg.Body) == message {
-                        received <- SmokeTestResult{Name: rabbitMqTestCheckMessage, Result: true}
-                } else {
-                        received <- SmokeTestResult{Name: rabbitMqTestCheckMessage, Result: false, Error: "Received message was different from sent message"}
-                }
-                close(received)
-                return
-        }
+func (r *rabbitMqTest) describe() (string, string) {
+	return r.rabbitMqKey, r.rabbitMqName
 }
 
 func (r *rabbitMqTest) run() SmokeTestResult {
-        fmt.Println("Running rabbitmq tests")
-
-        defer func() {
-                if r := recover(); r != nil {
-                        fmt.Printf("RabbitMQ test failed. Recovered from error:\n %v\n", r)
-                }
-        }()
-
-        results := make([]SmokeTestResult, 0)
-
-        // Create publishing channel.
-        createPublishingChannel := func() (interface{}, error) {
-                return r.connection.Channel()
-        }
-        obj, success := RunTestPart(createPublishingChannel, rabbitMqTestCreatePublishingChannel, &results)
-        if !success {
-                return OverallResult(r.rabbitMqKey, r.rabbitMqName, results)
-        }
-        channel := obj.(*amqp.Channel)
-        defer channel.Close()
-
-        // Declare queue.
-        declareQueue := func() (interface{}, error) {
-                return channel.QueueDeclare(r.qname, false, true, true, false, nil)
-        }
-        obj, success = RunTestPart(declareQueue, rabbitMqTestDeclareQueue, &results)
-        if !success {
-                return OverallResult(r.rabbitMqKey, r.rabbitMqName, results)
-        }
-        queue := obj.(amqp.Queue)
-
-        // Create message body to send and start listening.
-        message := fmt.Sprintf("%v", time.Now().Unix())
-        fmt.Println("starting listener")
-        listeningResults := make(chan SmokeTestResult)
-        go r.listen(listeningResults, message)
-
-        // Publish message.
-        msg := amqp.Publishing{ContentType: "text/plain", Body: []byte(message)}
-        err := channel.Publish("", queue.Name, false, false, msg)
-        if err != nil {
-                results = append(results, SmokeTestResult{Name: rabbitMqTestPublishMessage, Result: false, Error: err.Error()})
-                return OverallResult(r.rabbitMqKey, r.rabbitMqName, results)
-        }
-        results = append(results, SmokeTestResult{Name: rabbitMqTestPublishMessage, Result: true})
-
-        for listeningResult := range listeningResults {
-                results = append(results, listeningResult)
-        }
-
-        return OverallResult(r.rabbitMqKey, r.rabbitMqName, results)
+	fmt.Println("Running rabbitmq tests")
+
+	var connection *amqp.Connection
+	var publishing, listening *amqp.Channel
+	var confirms chan amqp.Confirmation
+	var returns chan amqp.Return
+	var queue amqp.Queue
+	var deliveries <-chan amqp.Delivery
+	var published time.Time
+
+	started := time.Now()
+	qname := resourceName(smokeTestResourcePrefix, started)
+	// Messages carry an ID unique to the run, so messages of earlier runs are told apart from lost ones.
+	correlationID := fmt.Sprintf("%s-%09d", qname, started.Nanosecond())
+	message := fmt.Sprintf("%v", started.Unix())
+
+	plan := testPlanNew(r.rabbitMqKey, r.rabbitMqName)
+
+	plan.step(rabbitMqTestOpenConnection, func(*SmokeTestResult) (err error) {
+		connection, err = amqp.DialTLS(r.uri, r.tlsConfig)
+		return err
+	})
+
+	// Publisher confirms tell whether the broker took responsibility for a message; returns tell that a
+	// mandatory message could not be routed to a queue.
+	plan.step(rabbitMqTestCreatePublishingChannel, func(*SmokeTestResult) (err error) {
+		if publishing, err = connection.Channel(); err != nil {
+			return err
+		}
+		if err := publishing.Confirm(false); err != nil {
+			return fmt.Errorf("Unable to enable publisher confirms: %v", err)
+		}
+		confirms = publishing.NotifyPublish(make(chan amqp.Confirmation, 1))
+		returns = publishing.NotifyReturn(make(chan amqp.Return, 1))
+		return nil
+	}, rabbitMqTestOpenConnection)
+
+	plan.step(rabbitMqTestDeclareQueue, func(*SmokeTestResult) (err error) {
+		args := amqp.Table{}
+		if r.queueExpiry > 0 {
+			args["x-expires"] = r.queueExpiry.Milliseconds()
+		}
+		queue, err = publishing.QueueDeclare(qname, false, true, true, false, args)
+		return err
+	}, rabbitMqTestCreatePublishingChannel)
+
+	plan.step(rabbitMqTestCreateListeningChannel, func(*SmokeTestResult) (err error) {
+		listening, err = connection.Channel()
+		return err
+	}, rabbitMqTestOpenConnection)
+
+	plan.step(rabbitMqTestConsumeMessage, func(*SmokeTestResult) (err error) {
+		deliveries, err = listening.Consume(queue.Name, "", true, false, false, false, nil)
+		return err
+	}, rabbitMqTestCreateListeningChannel, rabbitMqTestDeclareQueue)
+
+	plan.step(rabbitMqTestPublishMessage, func(result *SmokeTestResult) error {
+		msg := amqp.Publishing{ContentType: "text/plain", CorrelationId: correlationID, Timestamp: time.Now(), Body: []byte(message)}
+		published = time.Now()
+		if err := publishing.Publish("", queue.Name, true, false, msg); err != nil {
+			return err
+		}
+		return rabbitMqConfirm(confirms, returns, r.timeout)
+	}, rabbitMqTestConsumeMessage)
+
+	plan.step(rabbitMqTestCheckMessage, func(result *SmokeTestResult) error {
+		msg, err := rabbitMqReceive(deliveries, correlationID, r.timeout)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("message: %s\n", msg.Body)
+		if string(msg.Body) != message {
+			return fmt.Errorf("Received message was different from sent message")
+		}
+
+		latency := time.Since(published)
+		result.Metrics = map[string]float64{"roundTripMs": float64(latency.Microseconds()) / 1000}
+		result.Details = fmt.Sprintf("Round trip took %v", latency.Round(time.Microsecond))
+		return nil
+	}, rabbitMqTestPublishMessage)
+
+	// Closing the connection closes its channels; the exclusive queue is deleted with it. Deliveries that
+	// nobody waits for anymore are drained, as they would block the connection otherwise.
+	plan.cleanup(rabbitMqTestCloseConnection, func(*SmokeTestResult) error {
+		if deliveries != nil {
+			go func(deliveries <-chan amqp.Delivery) {
+				for range deliveries {
+				}
+			}(deliveries)
+		}
+		return connection.Close()
+	}, rabbitMqTestOpenConnection)
+
+	rabbitMqDeadLetterStep(plan, &connection, qname, correlationID, r.queueExpiry, r.timeout)
+	rabbitMqVhostIsolationStep(plan, r.uri, r.tlsConfig, r.isolationVhost)
+	r.rabbitMqProtocolSteps(plan, &connection, correlationID)
+
+	if r.management != nil {
+		r.management.steps(plan)
+	}
+
+	// Declared after closing the connection, so their cleanup runs first.
+	for _, queueType := range r.queueTypes {
+		rabbitMqQueueTypeSteps(plan, &connection, queueType, qname+"-"+queueType, correlationID, r.queueExpiry, r.timeout)
+	}
+
+	return plan.run()
+}
+
+// sweep deletes queues left behind by interrupted runs. Most run queues are exclusive or expire, but streams
+// can't. Queues can only be listed through the management API, so without it nothing is swept.
+func (r *rabbitMqTest) sweep(createdBefore time.Time) ([]string, error) {
+	if r.management == nil {
+		return nil, nil
+	}
+	return r.management.sweep(createdBefore)
+}
+
+// rabbitMqConfirm waits for the broker to confirm a message published as mandatory. A message that could not
+// be routed is returned before it is confirmed.
+func rabbitMqConfirm(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	select {
+	case returned := <-returns:
+		return fmt.Errorf("Message returned by the broker: %d %s", returned.ReplyCode, returned.ReplyText)
+	case confirmation, ok := <-confirms:
+		if !ok {
+			return fmt.Errorf("Channel closed before the message was confirmed")
+		}
+		select {
+		case returned := <-returns:
+			return fmt.Errorf("Message returned by the broker: %d %s", returned.ReplyCode, returned.ReplyText)
+		default:
+		}
+		if !confirmation.Ack {
+			return fmt.Errorf("Message not acknowledged by the broker")
+		}
+		return nil
+	case <-deadline.C:
+		return fmt.Errorf("No confirmation received within %v", timeout)
+	}
+}
+
+// rabbitMqReceive waits for the message with the given correlation ID and skips messages of earlier runs.
+func rabbitMqReceive(deliveries <-chan amqp.Delivery, correlationID string, timeout time.Duration) (amqp.Delivery, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case msg, ok := <-deliveries:
+			if !ok {
+				return amqp.Delivery{}, fmt.Errorf("Consumer closed before the message was received")
+			}
+			if msg.CorrelationId != correlationID {
+				fmt.Printf("Ignoring message of an earlier run: %s\n", msg.CorrelationId)
+				continue
+			}
+			return msg, nil
+		case <-deadline.C:
+			return amqp.Delivery{}, fmt.Errorf("No message received within %v", timeout)
+		}
+	}
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	rabbitMqTestDeadLetter     = "Dead-letter expired message"
+	rabbitMqTestVhostIsolation = "Vhost isolation"
+
+	// rabbitMqMessageTTL is short, so the message expires well within the timeout.
+	rabbitMqMessageTTL = 200 * time.Millisecond
+)
+
+// rabbitMqDeadLetterStep adds a step that publishes to a queue without consumers whose messages expire, and
+// waits for the message to be dead-lettered. Policies that override the TTL or dead-letter exchange of the
+// queue make this fail.
+func rabbitMqDeadLetterStep(plan *testPlan, connection **amqp.Connection, qname, correlationID string, queueExpiry, timeout time.Duration) {
+	exchange := qname + "-dlx"
+	deadLetterQueue := qname + "-dlq"
+	ttlQueue := qname + "-ttl"
+
+	plan.step(rabbitMqTestDeadLetter, func(result *SmokeTestResult) error {
+		channel, err := (*connection).Channel()
+		if err != nil {
+			return err
+		}
+		defer channel.Close()
+
+		if err := channel.Confirm(false); err != nil {
+			return fmt.Errorf("Unable to enable publisher confirms: %v", err)
+		}
+		confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+		returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+
+		// The exchange is deleted with its last binding, the exclusive queues with the connection.
+		if err := channel.ExchangeDeclare(exchange, amqp.ExchangeFanout, false, true, false, false, nil); err != nil {
+			return err
+		}
+		args := amqp.Table{}
+		if queueExpiry > 0 {
+			args["x-expires"] = queueExpiry.Milliseconds()
+		}
+		if _, err := channel.QueueDeclare(deadLetterQueue, false, true, true, false, args); err != nil {
+			return err
+		}
+		if err := channel.QueueBind(deadLetterQueue, "", exchange, false, nil); err != nil {
+			return err
+		}
+
+		ttlArgs := amqp.Table{"x-message-ttl": rabbitMqMessageTTL.Milliseconds(), "x-dead-letter-exchange": exchange}
+		for k, v := range args {
+			ttlArgs[k] = v
+		}
+		if _, err := channel.QueueDeclare(ttlQueue, false, true, true, false, ttlArgs); err != nil {
+			return err
+		}
+
+		deliveries, err := channel.Consume(deadLetterQueue, "", true, true, false, false, nil)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			go func() {
+				for range deliveries {
+				}
+			}()
+		}()
+
+		published := time.Now()
+		msg := amqp.Publishing{ContentType: "text/plain", CorrelationId: correlationID, Timestamp: published, Body: []byte(correlationID)}
+		if err := channel.Publish("", ttlQueue, true, false, msg); err != nil {
+			return err
+		}
+		if err := rabbitMqConfirm(confirms, returns, timeout); err != nil {
+			return err
+		}
+
+		delivery, err := rabbitMqReceive(deliveries, correlationID, rabbitMqMessageTTL+timeout)
+		if err != nil {
+			return fmt.Errorf("Expired message not dead-lettered: %v", err)
+		}
+		if reason := rabbitMqDeathReason(delivery); reason != "expired" {
+			return fmt.Errorf("Message dead-lettered with reason %q, expected \"expired\"", reason)
+		}
+
+		result.Details = fmt.Sprintf("Dead-lettered after %v with a TTL of %v", time.Since(published).Round(time.Millisecond), rabbitMqMessageTTL)
+		return nil
+	}, rabbitMqTestOpenConnection)
+}
+
+// rabbitMqDeathReason returns the reason of the most recent dead-lettering in the x-death header.
+func rabbitMqDeathReason(delivery amqp.Delivery) string {
+	deaths, _ := delivery.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return ""
+	}
+	death, _ := deaths[0].(amqp.Table)
+	reason, _ := death["reason"].(string)
+	return reason
+}
+
+// rabbitMqVhostIsolationStep adds a step that connects with the credentials of the binding to another vhost,
+// which the broker must refuse. It is left out when the binding is for that vhost itself.
+func rabbitMqVhostIsolationStep(plan *testPlan, uri string, tlsConfig *tls.Config, vhost string) {
+	parsed, err := amqp.ParseURI(uri)
+	if err != nil || vhost == "" || parsed.Vhost == vhost {
+		return
+	}
+	parsed.Vhost = vhost
+
+	plan.step(rabbitMqTestVhostIsolation, func(result *SmokeTestResult) error {
+		connection, err := amqp.DialTLS(parsed.String(), tlsConfig)
+		if err == nil {
+			connection.Close()
+			return fmt.Errorf("Credentials of the binding have access to vhost %q", vhost)
+		}
+		if errors.Is(err, amqp.ErrVhost) {
+			result.Details = fmt.Sprintf("Access to vhost %q refused", vhost)
+			return nil
+		}
+		return fmt.Errorf("Unable to connect to vhost %q: %v", vhost, err)
+	}, rabbitMqTestOpenConnection)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	rabbitMqTestVhosts     = "Virtual hosts health check"
+	rabbitMqTestNodes      = "Cluster nodes"
+	rabbitMqTestAlarms     = "Memory and disk alarms"
+	rabbitMqTestPartitions = "Network partitions"
+)
+
+// rabbitMqNode is the part of a node in /api/nodes the smoke tests look at.
+type rabbitMqNode struct {
+	Name       string   `json:"name"`
+	Running    bool     `json:"running"`
+	Partitions []string `json:"partitions"`
+}
+
+// rabbitMqManagement checks the cluster through the management API. A cluster in alarm state still accepts
+// connections, but blocks publishers.
+type rabbitMqManagement struct {
+	apiURI        *url.URL
+	vhost         string
+	httpClient    *http.Client
+	expectedNodes int
+}
+
+// rabbitMqManagementNew returns nil when the binding has no http_api_uri. The URI includes the management
+// credentials.
+func rabbitMqManagementNew(config SmokeTestConfig, creds map[string]interface{}) (*rabbitMqManagement, error) {
+	apiURI, _ := creds["http_api_uri"].(string)
+	if apiURI == "" {
+		return nil, nil
+	}
+
+	parsed, err := url.Parse(strings.TrimSuffix(apiURI, "/") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid http_api_uri: %v", err)
+	}
+	httpClient, err := newHTTPClient(config, bindingCACert(creds))
+	if err != nil {
+		return nil, err
+	}
+	vhost, _ := creds["vhost"].(string)
+
+	return &rabbitMqManagement{apiURI: parsed, vhost: vhost, httpClient: httpClient, expectedNodes: config.RabbitMqExpectedNodes}, nil
+}
+
+// rabbitMqStatusError is returned for an unexpected HTTP status of the management API.
+type rabbitMqStatusError struct {
+	path   string
+	status string
+	code   int
+}
+
+func (e *rabbitMqStatusError) Error() string {
+	return fmt.Sprintf("%s returned %s", e.path, e.status)
+}
+
+// forbidden tells that the user of the binding lacks the tag the endpoint requires.
+func (e *rabbitMqStatusError) forbidden() bool {
+	return e.code == http.StatusUnauthorized || e.code == http.StatusForbidden
+}
+
+// get fetches a path relative to the API URI, which already ends in /api/, and decodes the response when
+// it has one of the accepted status codes (by default 200 OK).
+func (m *rabbitMqManagement) get(path string, v interface{}, accepted ...int) error {
+	endpoint, err := m.apiURI.Parse(path)
+	if err != nil {
+		return err
+	}
+
+	resp, err := m.httpClient.Get(endpoint.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for _, code := range append(accepted, http.StatusOK) {
+		if resp.StatusCode == code {
+			return json.NewDecoder(resp.Body).Decode(v)
+		}
+	}
+	return &rabbitMqStatusError{path: endpoint.Path, status: resp.Status, code: resp.StatusCode}
+}
+
+// healthCheck calls a health check endpoint, which answers 503 Service Unavailable with the reason when the
+// check fails.
+func (m *rabbitMqManagement) healthCheck(path string) error {
+	var check struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := m.get(path, &check, http.StatusServiceUnavailable); err != nil {
+		return err
+	}
+	if check.Status != "ok" {
+		return fmt.Errorf("%s", check.Reason)
+	}
+	return nil
+}
+
+// sweep deletes the queues in the vhost that were created by runs before the given time.
+func (m *rabbitMqManagement) sweep(createdBefore time.Time) ([]string, error) {
+	var queues []struct {
+		Name string `json:"name"`
+	}
+	if err := m.get("queues/"+url.PathEscape(m.vhost)+"?columns=name", &queues); err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, queue := range queues {
+		created, ok := resourceCreated(smokeTestResourcePrefix, queue.Name)
+		if !ok || !created.Before(createdBefore) {
+			continue
+		}
+		if err := m.delete("queues/" + url.PathEscape(m.vhost) + "/" + url.PathEscape(queue.Name)); err != nil {
+			log.Printf("Unable to delete RabbitMQ queue %s: %v", queue.Name, err)
+			continue
+		}
+		removed = append(removed, "RabbitMQ queue "+queue.Name)
+	}
+	return removed, nil
+}
+
+func (m *rabbitMqManagement) delete(path string) error {
+	endpoint, err := m.apiURI.Parse(path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("%s returned %s", endpoint.Path, resp.Status)
+	}
+	return nil
+}
+
+func (m *rabbitMqManagement) steps(plan *testPlan) {
+	var nodes []rabbitMqNode
+	// Listing nodes requires the monitoring tag, which binding users usually lack.
+	nodesVisible := false
+
+	plan.step(rabbitMqTestVhosts, func(*SmokeTestResult) error {
+		return m.healthCheck("health/checks/virtual-hosts")
+	})
+
+	plan.step(rabbitMqTestAlarms, func(*SmokeTestResult) error {
+		if err := m.healthCheck("health/checks/alarms"); err != nil {
+			return fmt.Errorf("Publishers are blocked: %v", err)
+		}
+		return nil
+	})
+
+	plan.step(rabbitMqTestNodes, func(result *SmokeTestResult) error {
+		err := m.get("nodes", &nodes)
+		var statusErr *rabbitMqStatusError
+		if errors.As(err, &statusErr) && statusErr.forbidden() {
+			return degraded("Nodes not visible to the binding user (%v): listing them requires the monitoring tag", err)
+		}
+		if err != nil {
+			return err
+		}
+		nodesVisible = true
+
+		running := 0
+		var stopped []string
+		for _, node := range nodes {
+			if node.Running {
+				running++
+			} else {
+				stopped = append(stopped, node.Name)
+			}
+		}
+		result.Metrics = map[string]float64{"runningNodes": float64(running)}
+		result.Details = fmt.Sprintf("%d of %d node(s) running", running, len(nodes))
+
+		if running == 0 {
+			return fmt.Errorf("No running nodes")
+		}
+		if m.expectedNodes > 0 && running < m.expectedNodes {
+			return degraded("%d node(s) running, expected %d; not running: %s", running, m.expectedNodes, strings.Join(stopped, ", "))
+		}
+		if len(stopped) > 0 {
+			return degraded("Node(s) not running: %s", strings.Join(stopped, ", "))
+		}
+		return nil
+	})
+
+	plan.step(rabbitMqTestPartitions, func(*SmokeTestResult) error {
+		if !nodesVisible {
+			return degraded("Partitions unknown: nodes not visible to the binding user")
+		}
+		var partitions []string
+		for _, node := range nodes {
+			if len(node.Partitions) > 0 {
+				partitions = append(partitions, fmt.Sprintf("%s can't reach %s", node.Name, strings.Join(node.Partitions, ", ")))
+			}
+		}
+		if len(partitions) > 0 {
+			return fmt.Errorf("Network partition: %s", strings.Join(partitions, "; "))
+		}
+		return nil
+	}, rabbitMqTestNodes)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-stomp/stomp/v3"
+	"github.com/streadway/amqp"
+)
+
+const (
+	rabbitMqTestMQTT       = "MQTT publish and subscribe"
+	rabbitMqTestMQTTToAMQP = "MQTT to AMQP"
+	rabbitMqTestSTOMP      = "STOMP send and subscribe"
+
+	// The RabbitMQ MQTT plugin publishes to this exchange, with the slashes in the topic replaced by dots.
+	rabbitMqMQTTExchange = "amq.topic"
+)
+
+// rabbitMqEndpoint is an endpoint of another protocol than AMQP in the "protocols" of a binding.
+type rabbitMqEndpoint struct {
+	address  string
+	host     string
+	username string
+	password string
+	vhost    string
+	ssl      bool
+}
+
+// rabbitMqEndpointNew returns the endpoint of the protocol, or nil when the binding has none. An endpoint
+// without host or port is an error, which is reported by the steps of the protocol.
+func rabbitMqEndpointNew(creds map[string]interface{}, protocol string) (*rabbitMqEndpoint, error) {
+	protocols, _ := creds["protocols"].(map[string]interface{})
+	entry, found := protocols[protocol]
+	if !found {
+		return nil, nil
+	}
+	endpoint, ok := entry.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid %s endpoint in binding: expected an object", protocol)
+	}
+
+	host, _ := endpoint["host"].(string)
+	if hosts, _ := endpoint["hosts"].([]interface{}); host == "" && len(hosts) > 0 {
+		host, _ = hosts[0].(string)
+	}
+	port, _ := endpoint["port"].(float64)
+	if host == "" || port == 0 {
+		return nil, fmt.Errorf("Invalid %s endpoint in binding: host and port are required", protocol)
+	}
+
+	e := &rabbitMqEndpoint{address: net.JoinHostPort(host, strconv.Itoa(int(port))), host: host}
+	e.username, _ = endpoint["username"].(string)
+	e.password, _ = endpoint["password"].(string)
+	e.vhost, _ = endpoint["vhost"].(string)
+	if e.vhost == "" {
+		e.vhost, _ = creds["vhost"].(string)
+	}
+	e.ssl, _ = endpoint["ssl"].(bool)
+	return e, nil
+}
+
+// tlsConfig returns the TLS configuration for the endpoint, or nil when it doesn't use TLS.
+func (e *rabbitMqEndpoint) tlsConfig(base *tls.Config) *tls.Config {
+	if !e.ssl {
+		return nil
+	}
+	config := base.Clone()
+	config.ServerName = e.host
+	return config
+}
+
+// mqttConnect connects a client with an ID unique to the run. Sessions are clean, so nothing is left on the
+// broker after disconnecting.
+func (e *rabbitMqEndpoint) mqttConnect(tlsConfig *tls.Config, clientID string, timeout time.Duration) (mqtt.Client, error) {
+	scheme := "tcp"
+	if e.ssl {
+		scheme = "ssl"
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(scheme + "://" + e.address).
+		SetClientID(clientID).
+		SetUsername(e.username).
+		SetPassword(e.password).
+		SetTLSConfig(e.tlsConfig(tlsConfig)).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectRetry(false).
+		SetConnectTimeout(timeout)
+
+	client := mqtt.NewClient(options)
+	if err := mqttWait(client.Connect(), timeout); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// mqttWait waits for an MQTT operation to complete within the timeout.
+func mqttWait(token mqtt.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("No response from MQTT broker within %v", timeout)
+	}
+	return token.Error()
+}
+
+// stompConnect connects to the vhost of the endpoint. The deadline of the connection is not reset, so it bounds
+// the whole exchange with the broker, and receipts are awaited no longer than the timeout either.
+func (e *rabbitMqEndpoint) stompConnect(tlsConfig *tls.Config, timeout time.Duration) (*stomp.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if config := e.tlsConfig(tlsConfig); config != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.address, config)
+	} else {
+		conn, err = dialer.Dial("tcp", e.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := stomp.Connect(conn,
+		stomp.ConnOpt.Login(e.username, e.password),
+		stomp.ConnOpt.Host(e.vhost),
+		stomp.ConnOpt.HeartBeat(0, 0),
+		stomp.ConnOpt.RcvReceiptTimeout(timeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// rabbitMqProtocolSteps adds steps for the MQTT and STOMP endpoints in the binding.
+func (r *rabbitMqTest) rabbitMqProtocolSteps(plan *testPlan, connection **amqp.Connection, runID string) {
+	// MQTT topics use slashes, AMQP routing keys dots.
+	topic := "smoketest/" + runID
+	routingKey := strings.ReplaceAll(topic, "/", ".")
+
+	if r.mqttErr != nil {
+		plan.step(rabbitMqTestMQTT, func(*SmokeTestResult) error {
+			return r.mqttErr
+		})
+	}
+	if r.mqtt != nil {
+		plan.step(rabbitMqTestMQTT, func(result *SmokeTestResult) error {
+			client, err := r.mqtt.mqttConnect(r.tlsConfig, runID, r.timeout)
+			if err != nil {
+				return err
+			}
+			defer client.Disconnect(250)
+
+			messages := make(chan mqtt.Message, 1)
+			handler := func(_ mqtt.Client, message mqtt.Message) {
+				select {
+				case messages <- message:
+				default:
+				}
+			}
+			if err := mqttWait(client.Subscribe(topic, 1, handler), r.timeout); err != nil {
+				return err
+			}
+			published := time.Now()
+			if err := mqttWait(client.Publish(topic, 1, false, runID), r.timeout); err != nil {
+				return err
+			}
+
+			deadline := time.NewTimer(r.timeout)
+			defer deadline.Stop()
+			select {
+			case message := <-messages:
+				if message.Topic() != topic || string(message.Payload()) != runID {
+					return fmt.Errorf("Received message was different from sent message")
+				}
+			case <-deadline.C:
+				return fmt.Errorf("No message received within %v", r.timeout)
+			}
+			result.Details = fmt.Sprintf("Round trip took %v", time.Since(published).Round(time.Microsecond))
+			return nil
+		})
+
+		// A message published over MQTT must reach AMQP consumers of the topic exchange.
+		plan.step(rabbitMqTestMQTTToAMQP, func(*SmokeTestResult) error {
+			channel, err := (*connection).Channel()
+			if err != nil {
+				return err
+			}
+			defer channel.Close()
+
+			queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+			if err != nil {
+				return err
+			}
+			if err := channel.QueueBind(queue.Name, routingKey, rabbitMqMQTTExchange, false, nil); err != nil {
+				return err
+			}
+			deliveries, err := channel.Consume(queue.Name, "", true, true, false, false, nil)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				go func() {
+					for range deliveries {
+					}
+				}()
+			}()
+
+			client, err := r.mqtt.mqttConnect(r.tlsConfig, runID+"-amqp", r.timeout)
+			if err != nil {
+				return err
+			}
+			defer client.Disconnect(250)
+			if err := mqttWait(client.Publish(topic, 1, false, runID), r.timeout); err != nil {
+				return err
+			}
+
+			deadline := time.NewTimer(r.timeout)
+			defer deadline.Stop()
+			select {
+			case msg, ok := <-deliveries:
+				if !ok {
+					return fmt.Errorf("Consumer closed before the message was received")
+				}
+				if string(msg.Body) != runID {
+					return fmt.Errorf("Received message was different from sent message")
+				}
+				return nil
+			case <-deadline.C:
+				return fmt.Errorf("Message published over MQTT not received over AMQP within %v", r.timeout)
+			}
+		}, rabbitMqTestOpenConnection)
+	}
+
+	if r.stompErr != nil {
+		plan.step(rabbitMqTestSTOMP, func(*SmokeTestResult) error {
+			return r.stompErr
+		})
+	}
+	if r.stomp != nil {
+		plan.step(rabbitMqTestSTOMP, func(result *SmokeTestResult) error {
+			client, err := r.stomp.stompConnect(r.tlsConfig, r.timeout)
+			if err != nil {
+				return err
+			}
+			// Disconnect and Unsubscribe wait for a receipt without a timeout, which blocks the run on a
+			// broker that stops answering. Closing the connection ends the subscription as well.
+			defer client.MustDisconnect()
+
+			destination := "/topic/" + routingKey
+			subscription, err := client.Subscribe(destination, stomp.AckAuto)
+			if err != nil {
+				return err
+			}
+
+			// The receipt confirms the broker processed the message; frames are handled in order, so the
+			// subscription is in place.
+			published := time.Now()
+			if err := client.Send(destination, "text/plain", []byte(runID), stomp.SendOpt.Receipt); err != nil {
+				return err
+			}
+
+			deadline := time.NewTimer(r.timeout)
+			defer deadline.Stop()
+			select {
+			case message, ok := <-subscription.C:
+				if !ok {
+					return fmt.Errorf("Subscription closed before the message was received")
+				}
+				if message.Err != nil {
+					return message.Err
+				}
+				if string(message.Body) != runID {
+					return fmt.Errorf("Received message was different from sent message")
+				}
+			case <-deadline.C:
+				return fmt.Errorf("No message received within %v", r.timeout)
+			}
+			result.Details = fmt.Sprintf("Round trip took %v", time.Since(published).Round(time.Microsecond))
+			return nil
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	rabbitMqQueueTypeQuorum = "quorum"
+	rabbitMqQueueTypeStream = "stream"
+
+	// Streams can't expire, so what a run leaves behind is bounded by retention until the sweeper deletes it.
+	rabbitMqStreamMaxBytes     = 1 << 20
+	rabbitMqStreamSegmentBytes = 1 << 20
+)
+
+// rabbitMqQueueTypeSteps adds steps that declare a queue of the given type, round-trip a message through it
+// and delete it again. Quorum queues and streams are replicated, so this proves the cluster has enough nodes
+// and the feature flags are enabled. Queues that outlive an interrupted run expire (quorum) or are limited by
+// retention (stream) and are deleted by the sweeper.
+func rabbitMqQueueTypeSteps(plan *testPlan, connection **amqp.Connection, queueType, qname, correlationID string, queueExpiry, timeout time.Duration) {
+	declare := fmt.Sprintf("Declare %s queue", queueType)
+	roundTrip := fmt.Sprintf("Round trip via %s queue", queueType)
+	remove := fmt.Sprintf("Delete %s queue", queueType)
+
+	var channel *amqp.Channel
+	var confirms chan amqp.Confirmation
+	var returns chan amqp.Return
+	var deliveries <-chan amqp.Delivery
+
+	plan.step(declare, func(*SmokeTestResult) (err error) {
+		if channel, err = (*connection).Channel(); err != nil {
+			return err
+		}
+		if err := channel.Confirm(false); err != nil {
+			return fmt.Errorf("Unable to enable publisher confirms: %v", err)
+		}
+		confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+		returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+
+		// Replicated queues must be durable and can't be exclusive or auto-delete.
+		args := amqp.Table{"x-queue-type": queueType}
+		if queueType == rabbitMqQueueTypeStream {
+			args["x-max-length-bytes"] = int64(rabbitMqStreamMaxBytes)
+			args["x-stream-max-segment-size-bytes"] = int64(rabbitMqStreamSegmentBytes)
+			if queueExpiry > 0 {
+				args["x-max-age"] = fmt.Sprintf("%ds", int64(queueExpiry.Seconds()))
+			}
+		} else if queueExpiry > 0 {
+			args["x-expires"] = queueExpiry.Milliseconds()
+		}
+		_, err = channel.QueueDeclare(qname, true, false, false, false, args)
+		return err
+	}, rabbitMqTestOpenConnection)
+
+	plan.step(roundTrip, func(result *SmokeTestResult) (err error) {
+		args := amqp.Table{}
+		autoAck := true
+		if queueType == rabbitMqQueueTypeStream {
+			// Streams are read from an offset and need a prefetch limit and manual acknowledgements.
+			if err := channel.Qos(1, 0, false); err != nil {
+				return err
+			}
+			args["x-stream-offset"] = "first"
+			autoAck = false
+		}
+		if deliveries, err = channel.Consume(qname, "", autoAck, false, false, false, args); err != nil {
+			return err
+		}
+
+		published := time.Now()
+		msg := amqp.Publishing{ContentType: "text/plain", CorrelationId: correlationID, Timestamp: published, Body: []byte(correlationID)}
+		if err := channel.Publish("", qname, true, false, msg); err != nil {
+			return err
+		}
+		if err := rabbitMqConfirm(confirms, returns, timeout); err != nil {
+			return err
+		}
+
+		delivery, err := rabbitMqReceive(deliveries, correlationID, timeout)
+		if err != nil {
+			return err
+		}
+		if !autoAck {
+			if err := delivery.Ack(false); err != nil {
+				return err
+			}
+		}
+		if string(delivery.Body) != correlationID {
+			return fmt.Errorf("Received message was different from sent message")
+		}
+
+		latency := time.Since(published)
+		result.Metrics = map[string]float64{"roundTripMs": float64(latency.Microseconds()) / 1000}
+		result.Details = fmt.Sprintf("Round trip took %v", latency.Round(time.Microsecond))
+		return nil
+	}, declare)
+
+	plan.cleanup(remove, func(*SmokeTestResult) error {
+		if deliveries != nil {
+			go func(deliveries <-chan amqp.Delivery) {
+				for range deliveries {
+				}
+			}(deliveries)
+		}
+		defer channel.Close()
+		_, err := channel.QueueDelete(qname, false, false, false)
+		return err
+	}, declare)
+}
@@ -1,23 +1,36 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/go-redis/redis"
 )
 
 const (
+	redisTestPing   = "Ping"
+	redisTestSet    = "Set key with TTL"
+	redisTestGet    = "Get key"
+	redisTestTTL    = "Check TTL"
+	redisTestDelete = "Delete key"
+
+	// redisKeyTTL makes keys of interrupted runs expire by themselves.
+	redisKeyTTL = time.Minute
 )
 
 type redisTest struct {
 	client *redis.Client
 	redisKey string
 	redisName string
-
+	canary *canary
 }
 
-func redisTestNew(env *cfenv.App, serviceName, friendlyName string) SmokeTest {
+func redisTestNew(env *cfenv.App, serviceName, friendlyName string) (test SmokeTest) {
+	defer recoverTestNew(&test, serviceName, friendlyName)
+
 	// TODO: replace with searching on tag basis, possibly resulting in multiple returns in case of multiple matches.
 	redisServices, err := env.Services.WithLabel(serviceName)
 	if err != nil {
@@ -35,26 +48,109 @@ func redisTestNew(env *cfenv.App, serviceName, friendlyName string) SmokeTest {
 		}),
 		redisKey: serviceName,
 		redisName: friendlyName,
+		canary: canaryNew(serviceName),
 	}
 }
 
 func (r *redisTest) run() SmokeTestResult {
-	results := make([]SmokeTestResult, 0)
+	started := time.Now()
+	value := fmt.Sprintf("%v", started.UnixNano())
+	// Instances of the app share the Redis instance and run in the same second, so the key includes the
+	// value as well.
+	key := resourceName(smokeTestResourcePrefix, started) + "-" + value
+
+	plan := testPlanNew(r.redisKey, r.redisName)
+
+	plan.step(redisTestPing, func(*SmokeTestResult) error {
+		pong, err := r.client.Ping().Result()
+		if err != nil {
+			return err
+		}
+		if pong != "PONG" {
+			return errors.New("No PONG reply from Redis")
+		}
+		return nil
+	})
+
+	// PING succeeds on an instance that refuses writes, so a key is written and read back.
+	plan.step(redisTestSet, func(*SmokeTestResult) error {
+		return redisError(r.client.Set(key, value, redisKeyTTL).Err())
+	}, redisTestPing)
+
+	plan.step(redisTestGet, func(*SmokeTestResult) error {
+		got, err := r.client.Get(key).Result()
+		if err == redis.Nil {
+			return errors.New("Key not found after writing it")
+		}
+		if err != nil {
+			return redisError(err)
+		}
+		if got != value {
+			return errors.New("Read value was different from written value")
+		}
+		return nil
+	}, redisTestSet)
+
+	plan.step(redisTestTTL, func(result *SmokeTestResult) error {
+		ttl, err := r.client.TTL(key).Result()
+		if err != nil {
+			return redisError(err)
+		}
+		// go-redis reports a key without expiry and a missing key as negative durations.
+		if ttl <= 0 || ttl > redisKeyTTL {
+			return fmt.Errorf("TTL of key is %v, expected at most %v", ttl, redisKeyTTL)
+		}
+		result.Details = fmt.Sprintf("TTL %v", ttl)
+		return nil
+	}, redisTestSet)
 
-	ping := func() (interface{}, error) {
-		return r.client.Ping().Result()
+	plan.step(canaryTest, func(result *SmokeTestResult) error {
+		return r.canary.check(r, result)
+	}, redisTestPing)
+
+	plan.cleanup(redisTestDelete, func(*SmokeTestResult) error {
+		deleted, err := r.client.Del(key).Result()
+		if err != nil {
+			return redisError(err)
+		}
+		if deleted != 1 {
+			return fmt.Errorf("Deleted %d keys, expected 1", deleted)
+		}
+		return nil
+	}, redisTestSet)
+
+	return plan.run()
+}
+
+// redisError tells an instance that is out of memory or read-only apart from other errors. Both still answer
+// PING: the first has reached maxmemory with the noeviction policy, the second is a replica, e.g. after a
+// failover.
+func redisError(err error) error {
+	if err == nil {
+		return nil
 	}
-	obj, success := RunTestPart(ping, "Ping", &results)
-	if !success {
-		return OverallResult(r.redisKey, r.redisName, results)
+	switch msg := err.Error(); {
+	case strings.HasPrefix(msg, "OOM "):
+		return fmt.Errorf("Redis is out of memory and refuses writes: %v", msg)
+	case strings.HasPrefix(msg, "READONLY "):
+		return fmt.Errorf("Redis is a read-only replica: %v", msg)
 	}
-	pong := obj.(string)
+	return err
+}
 
-	if pong != "PONG" {
-		results = append(results, SmokeTestResult{Name: "Pong", Result: false, Error: "No PONG reply from Redis"})
-	} else {
-		results = append(results, SmokeTestResult{Name: "Pong", Result: true})
+func (r *redisTest) describe() (string, string) {
+	return r.redisKey, r.redisName
+}
+
+// read and write keep the canary in a key without expiry.
+func (r *redisTest) read() (string, bool, error) {
+	payload, err := r.client.Get(canaryName).Result()
+	if err == redis.Nil {
+		return "", false, nil
 	}
+	return payload, err == nil, err
+}
 
-	return OverallResult(r.redisKey, r.redisName, results)
+func (r *redisTest) write(payload string) error {
+	return redisError(r.client.Set(canaryName, payload, 0).Err())
 }
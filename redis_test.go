@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRedisError(t *testing.T) {
+	other := errors.New("dial tcp 127.0.0.1:6379: connect: connection refused")
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "no error"},
+		{name: "out of memory", err: errors.New("OOM command not allowed when used memory > 'maxmemory'."), want: "Redis is out of memory and refuses writes: OOM command not allowed"},
+		{name: "read-only replica", err: errors.New("READONLY You can't write against a read only replica."), want: "Redis is a read-only replica: READONLY You can't write"},
+		{name: "other errors are unchanged", err: other, want: other.Error()},
+		{name: "prefix must be a whole word", err: errors.New("OOMKilled"), want: "OOMKilled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := redisError(tt.err)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("redisError(nil) = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("redisError(%v) = %v, want %q", tt.err, err, tt.want)
+			}
+		})
+	}
+
+	if redisError(other) != other {
+		t.Errorf("redisError did not return other errors as they are")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of runs of which the events are kept, so clients can still (re)play them after a run finished.
+const runEventsRetained = 20
+
+const (
+	runEventQueued        = "run-queued"
+	runEventStarted       = "run-started"
+	runEventTestStarted   = "test-started"
+	runEventStepCompleted = "step-completed"
+	runEventTestCompleted = "test-completed"
+	runEventCompleted     = "run-completed"
+)
+
+// currentRun receives the progress of the run that is executing. Runs are serialized by the program, so
+// there is at most one.
+var currentRun *runEvents
+
+type runEvent struct {
+	Type   string           `json:"type"`
+	Time   time.Time        `json:"time"`
+	RunID  string           `json:"runId"`
+	Key    string           `json:"key,omitempty"`
+	Name   string           `json:"name,omitempty"`
+	Result *SmokeTestResult `json:"result,omitempty"`
+}
+
+// runEvents records the progress of a single run and wakes up subscribers on every new event.
+type runEvents struct {
+	id string
+
+	mutex    sync.Mutex
+	events   []runEvent
+	started  bool
+	finished bool
+	changed  chan struct{}
+
+	// The test that is currently running.
+	key  string
+	name string
+}
+
+func runEventsNew(id string) *runEvents {
+	r := &runEvents{id: id, changed: make(chan struct{})}
+	r.emit(runEvent{Type: runEventQueued})
+	return r
+}
+
+func (r *runEvents) emit(event runEvent) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	event.Time = time.Now()
+	event.RunID = r.id
+	r.events = append(r.events, event)
+	switch event.Type {
+	case runEventStarted:
+		r.started = true
+	case runEventCompleted:
+		r.finished = true
+	}
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *runEvents) testStarted(key, name string) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	r.key, r.name = key, name
+	r.mutex.Unlock()
+
+	r.emit(runEvent{Type: runEventTestStarted, Key: key, Name: name})
+}
+
+func (r *runEvents) stepCompleted(result SmokeTestResult) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	key, name := r.key, r.name
+	r.mutex.Unlock()
+
+	r.emit(runEvent{Type: runEventStepCompleted, Key: key, Name: name, Result: &result})
+}
+
+func (r *runEvents) testCompleted(result SmokeTestResult) {
+	r.emit(runEvent{Type: runEventTestCompleted, Key: result.Key, Name: result.Name, Result: &result})
+}
+
+// since returns the events from index n on, whether the run finished and a channel that is closed when a
+// new event arrives.
+func (r *runEvents) since(n int) ([]runEvent, bool, <-chan struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if n > len(r.events) {
+		n = len(r.events)
+	}
+	return r.events[n:], r.finished, r.changed
+}
+
+// runStreams keeps the events of the most recent runs.
+type runStreams struct {
+	mutex sync.Mutex
+	order []string
+	runs  map[string]*runEvents
+}
+
+func runStreamsNew() *runStreams {
+	return &runStreams{runs: make(map[string]*runEvents)}
+}
+
+func (s *runStreams) register() *runEvents {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	events := runEventsNew(runIDNew(time.Now()))
+	s.runs[events.id] = events
+	s.order = append(s.order, events.id)
+	if len(s.order) > runEventsRetained {
+		delete(s.runs, s.order[0])
+		s.order = s.order[1:]
+	}
+	return events
+}
+
+func (s *runStreams) get(id string) (*runEvents, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	events, ok := s.runs[id]
+	return events, ok
+}
+
+// current returns the run that is executing, if any. Runs are serialized, so at most one has started and not
+// finished.
+func (s *runStreams) current() (*runEvents, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, id := range s.order {
+		events := s.runs[id]
+		events.mutex.Lock()
+		running := events.started && !events.finished
+		events.mutex.Unlock()
+		if running {
+			return events, true
+		}
+	}
+	return nil, false
+}
+
+// serveEvents streams the events of a run as Server-Sent Events until the run completes or the client goes
+// away. Events that happened before the client connected are replayed, starting after Last-Event-ID when
+// the client reconnects.
+func serveEvents(w http.ResponseWriter, r *http.Request, events *runEvents) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	next := 0
+	if lastEventID, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		next = lastEventID + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		pending, finished, changed := events.since(next)
+		for _, event := range pending {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", next, event.Type, data)
+			next++
+		}
+		flusher.Flush()
+
+		if finished {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -2,21 +2,28 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	cfenv "github.com/cloudfoundry-community/go-cfenv"
 )
 
+const (
+	s3Key  = "s3"
+	s3Name = "S3"
+)
+
 type CredBucket struct {
 	URI        string `json:"uri"`
 	Name       string `json:"name"`
@@ -37,9 +44,12 @@ type Credentials struct {
 type s3Test struct {
 	Client *s3.S3
 	Bucket string
+	canary *canary
 }
 
-func s3TestNew(env *cfenv.App) SmokeTest {
+func s3TestNew(env *cfenv.App, config SmokeTestConfig) (test SmokeTest) {
+	defer recoverTestNew(&test, s3Key, s3Name)
+
 	s3Services, err := env.Services.WithLabel("s3-bucket")
 	if err != nil {
 		fmt.Println("smoketest app not bound to an s3 service")
@@ -49,17 +59,14 @@ func s3TestNew(env *cfenv.App) SmokeTest {
 	creds := s3Services[0].Credentials
 	bucketMap := creds["buckets"].([]interface{})[0].(map[string]interface{})
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
-	}
-
-	httpClient := http.Client{
-		Transport: tr,
-		Timeout:   15 * time.Second,
+	httpClient, err := newHTTPClient(config, bindingCACert(creds))
+	if err != nil {
+		fmt.Println("Unable to create http client for s3: " + err.Error())
+		return nil
 	}
 
 	sess, err := session.NewSession(&aws.Config{
-		HTTPClient:       &httpClient,
+		HTTPClient:       httpClient,
 		Credentials:      credentials.NewStaticCredentials(creds["access_key_id"].(string), creds["secret_access_key"].(string), ""),
 		Endpoint:         aws.String(creds["endpoint"].(string)),
 		Region:           aws.String(bucketMap["region"].(string)),
@@ -70,13 +77,13 @@ func s3TestNew(env *cfenv.App) SmokeTest {
 	return &s3Test{
 		Client: s3.New(sess),
 		Bucket: bucketMap["bucket"].(string),
+		canary: canaryNew(s3Key),
 	}
 }
 
 func (t *s3Test) run() SmokeTestResult {
-	results := make([]SmokeTestResult, 0)
-
 	filename := path.Join("./", "s3testfile")
+	key := resourceName(smokeTestResourcePrefix, time.Now())
 
 	//create test file
 	write := func() (interface{}, error) {
@@ -102,7 +109,7 @@ func (t *s3Test) run() SmokeTestResult {
 		upFile.Read(fileBuffer)
 		_, err = t.Client.PutObject(&s3.PutObjectInput{
 			Bucket:             aws.String(t.Bucket),
-			Key:                aws.String("s3testfile"),
+			Key:                aws.String(key),
 			ACL:                aws.String("private"),
 			Body:               bytes.NewReader(fileBuffer),
 			ContentDisposition: aws.String("attachment"),
@@ -116,7 +123,85 @@ func (t *s3Test) run() SmokeTestResult {
 		return true, nil
 	}
 
-	RunTestPart(write, "Create local testfile", &results)
-	RunTestPart(upload, "Upload file to S3", &results)
-	return OverallResult("s3", "S3", results)
+	remove := func() (interface{}, error) {
+		_, err := t.Client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(t.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	plan := testPlanNew(s3Key, s3Name)
+	plan.step("Create local testfile", testPartStep(write))
+	plan.step("Upload file to S3", testPartStep(upload), "Create local testfile")
+	plan.step(canaryTest, func(result *SmokeTestResult) error {
+		return t.canary.check(t, result)
+	})
+	plan.cleanup("Delete file from S3", testPartStep(remove), "Upload file to S3")
+	return plan.run()
+}
+
+func (t *s3Test) describe() (string, string) {
+	return s3Key, s3Name
+}
+
+// sweep deletes test files that were uploaded by interrupted runs.
+func (t *s3Test) sweep(createdBefore time.Time) ([]string, error) {
+	var removed []string
+
+	err := t.Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(t.Bucket),
+		Prefix: aws.String(smokeTestResourcePrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			created, ok := resourceCreated(smokeTestResourcePrefix, *object.Key)
+			if !ok || !created.Before(createdBefore) {
+				continue
+			}
+			_, err := t.Client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(t.Bucket), Key: object.Key})
+			if err != nil {
+				log.Printf("Unable to delete s3 object %s: %v", *object.Key, err)
+				continue
+			}
+			removed = append(removed, "s3 object "+*object.Key)
+		}
+		return true
+	})
+
+	return removed, err
+}
+
+// read and write keep the canary in an object.
+func (t *s3Test) read() (string, bool, error) {
+	object, err := t.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(t.Bucket),
+		Key:    aws.String(canaryName),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer object.Body.Close()
+
+	payload, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return "", false, err
+	}
+	return string(payload), true, nil
+}
+
+func (t *s3Test) write(payload string) error {
+	_, err := t.Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(t.Bucket),
+		Key:         aws.String(canaryName),
+		ACL:         aws.String("private"),
+		Body:        strings.NewReader(payload),
+		ContentType: aws.String("text/plain"),
+	})
+	return err
 }
@@ -15,7 +15,9 @@ type smbTest struct {
 	name string
 }
 
-func smbTestNew(env *cfenv.App, serviceName, friendlyName string) SmokeTest {
+func smbTestNew(env *cfenv.App, serviceName, friendlyName string) (test SmokeTest) {
+        defer recoverTestNew(&test, serviceName, friendlyName)
+
         smbServices, err := env.Services.WithLabel(serviceName)
         if err != nil {
                 fmt.Println("smb service not bound to smoketest app.")
@@ -60,3 +62,7 @@ func (n *smbTest) run() SmokeTestResult {
 	return OverallResult(n.key, n.name, results)
 }
 
+func (n *smbTest) describe() (string, string) {
+	return n.key, n.name
+}
+
@@ -5,65 +5,204 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
 )
 
 type SmokeTestProgram interface {
 	init(*cfenv.App, SmokeTestConfig)
-	run() []SmokeTestResult
+	run() (string, []SmokeTestResult)
+	start() *runEvents
+	events(string) (*runEvents, bool)
+	current() (*runEvents, bool)
 	publish([]SmokeTestResult) error
+	sweep() SweepReport
+	lastSweep() SweepReport
+	history() *resultHistory
+	availability() *availabilityLog
+	maintenance() *maintenanceSchedule
 }
 
 type smokeTestProgram struct {
-	tests []SmokeTest
+	tests      []SmokeTest
+	config     SmokeTestConfig
+	httpClient *http.Client
+	runs       *resultHistory
+	uptime     *availabilityLog
+	state      *stateStore
+	windows    *maintenanceSchedule
+	streams    *runStreams
+	// sweepers are the tests that leave resources behind, plus sweepers for services that aren't tested.
+	sweepers []Sweeper
+
+	// Runs are serialized: tests share their connections and clients, and currentRun receives the progress of
+	// a single run.
+	runMutex sync.Mutex
+
+	sweepMutex      sync.Mutex
+	lastSweepReport SweepReport
 }
 
 type SmokeTest interface {
 	run() SmokeTestResult
+	// describe returns the key and name of the test, so it can be reported even when run panics.
+	describe() (string, string)
 }
 
 type SmokeTestResult struct {
-	Key              string            `json:"key,omitempty"`
-	Result           bool              `json:"result"`
-	Name             string            `json:"name"`
-	Error            string            `json:"error,omitempty"`
-	ErrorDescription string            `json:"errorDescription,omitempty"`
-	StatusCode       *int              `json:"statusCode,omitempty"`
-	Results          []SmokeTestResult `json:"results,omitempty"`
+	Key              string             `json:"key,omitempty"`
+	Result           bool               `json:"result"`
+	Name             string             `json:"name"`
+	Error            string             `json:"error,omitempty"`
+	ErrorDescription string             `json:"errorDescription,omitempty"`
+	StatusCode       *int               `json:"statusCode,omitempty"`
+	Details          string             `json:"details,omitempty"`
+	Metrics          map[string]float64 `json:"metrics,omitempty"`
+	DurationMs       int64              `json:"durationMs,omitempty"`
+	Maintenance      string             `json:"maintenance,omitempty"`
+	Degraded         bool               `json:"degraded,omitempty"`
+	Skipped          bool               `json:"skipped,omitempty"`
+	Results          []SmokeTestResult  `json:"results,omitempty"`
 }
 
 func (s *smokeTestProgram) init(env *cfenv.App, config SmokeTestConfig) {
+	s.config = config
+
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		panic(err)
+	}
+	s.httpClient = httpClient
+	s.runs = resultHistoryNew(config.HistorySize)
+
+	var retention time.Duration
+	for _, w := range config.SLAWindows {
+		window, err := parseWindow(w)
+		if err != nil {
+			panic(err)
+		}
+		if window > retention {
+			retention = window
+		}
+	}
+	s.state = stateStoreNew(config.StateDir)
+	canaries = canaryLedgerNew(s.state)
+	s.uptime = availabilityLogNew(retention, config.SLAMaxGap, s.state)
+	s.windows = maintenanceScheduleNew(s.state)
+	s.streams = runStreamsNew()
+
 	s.tests = append(s.tests,
 		meTestNew(),
-		mySQLTestNew(env),
-		rabbitMqTestNew(env, "p-rabbitmq", "RabbitMQ Shared Cluster"),
-		rabbitMqTestNew(env, "p.rabbitmq", "RabbitMQ On-Demand"),
+		mySQLTestNew(env, config),
+		rabbitMqTestNew(env, config, "p-rabbitmq", "RabbitMQ Shared Cluster"),
+		rabbitMqTestNew(env, config, "p.rabbitmq", "RabbitMQ On-Demand"),
 		redisTestNew(env, "p-redis", "Redis Shared Cluster"),
 		redisTestNew(env, "p.redis", "Redis On-Demand"),
-		postgresTestNew(env, "postgres-db", "Postgres"),
+		postgresTestNew(env, config, "postgres-db", "Postgres"),
 		smbTestNew(env, "shared-volume", "shared SMB Volume (netApp)"),
-		s3TestNew(env),
+		s3TestNew(env, config),
 		k8sTestNew(config),
 	)
 
+	for _, test := range s.tests {
+		if sweeper, ok := test.(Sweeper); ok {
+			s.sweepers = append(s.sweepers, sweeper)
+		}
+	}
+	// The SSO test isn't run, but SCIM users left behind by it are still swept.
+	if sweeper := ssoSweeperNew(env, config); sweeper != nil {
+		s.sweepers = append(s.sweepers, sweeper)
+	}
+}
+
+// run runs all tests and waits for the results. It returns the id of the run, so its progress and results
+// can be looked up.
+func (s *smokeTestProgram) run() (string, []SmokeTestResult) {
+	events := s.streams.register()
+	return events.id, s.execute(events)
 }
 
-func (s *smokeTestProgram) run() []SmokeTestResult {
+// start runs all tests in the background. Progress can be followed through the returned events.
+func (s *smokeTestProgram) start() *runEvents {
+	events := s.streams.register()
+	go func() {
+		results := s.execute(events)
+		if err := s.publish(results); err != nil {
+			log.Printf("Unable to publish results to dashboard. Error: %v", err)
+		}
+	}()
+	return events
+}
+
+func (s *smokeTestProgram) events(id string) (*runEvents, bool) {
+	return s.streams.get(id)
+}
+
+func (s *smokeTestProgram) current() (*runEvents, bool) {
+	return s.streams.current()
+}
+
+func (s *smokeTestProgram) execute(events *runEvents) []SmokeTestResult {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	currentRun = events
+	defer func() { currentRun = nil }()
 
 	//	results := make([]SmokeTestResult, len(s.tests), len(s.tests))
 	var results []SmokeTestResult
 
+	started := time.Now()
+	events.emit(runEvent{Type: runEventStarted})
 	for _, test := range s.tests {
 		if test != nil {
-			results = append(results, test.run())
+			events.testStarted(test.describe())
+			results = append(results, runTest(test))
+			s.windows.annotate(localSite(), started, results[len(results)-1:])
+			events.testCompleted(results[len(results)-1])
 		}
 	}
+
+	s.runs.add(runRecord{ID: events.id, Started: started, Finished: time.Now(), Results: results})
+	s.uptime.record(localSite(), started, results)
+	events.emit(runEvent{Type: runEventCompleted})
 	return results
 }
 
+func (s *smokeTestProgram) history() *resultHistory {
+	return s.runs
+}
+
+func (s *smokeTestProgram) availability() *availabilityLog {
+	return s.uptime
+}
+
+func (s *smokeTestProgram) maintenance() *maintenanceSchedule {
+	return s.windows
+}
+
+// runTest runs a single test and reports a panic as a failed test, so one broken test does not take down
+// the app.
+func runTest(test SmokeTest) (result SmokeTestResult) {
+	started := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			key, name := test.describe()
+			result = SmokeTestResult{Key: key, Name: name, Result: false, Error: panicError(r).Error()}
+		}
+		result.DurationMs = time.Since(started).Milliseconds()
+	}()
+
+	return test.run()
+}
+
 func (s *smokeTestProgram) publish(results []SmokeTestResult) error {
 	// Read dashboard data endpoint from environment.
 	dashboardDataEndpoint := os.Getenv("DASHBOARD_DATA_ENDPOINT")
@@ -71,12 +210,13 @@ func (s *smokeTestProgram) publish(results []SmokeTestResult) error {
 		return fmt.Errorf("DASHBOARD_DATA_ENDPOINT env variable not set. Cannot post data to dashboard.")
 	}
 
-	// Post data to dashboard.
-	resultBytes, err := json.Marshal(results)
+	// Post data to dashboard. Results produced during maintenance are left out, so they don't raise alerts.
+	// Degraded tests are posted as passing with "degraded": true and the reason in their details.
+	resultBytes, err := json.Marshal(withoutMaintenance(results))
 	if err != nil {
 		return err
 	}
-	postResponse, err := http.Post(dashboardDataEndpoint, "application/json", bytes.NewReader(resultBytes))
+	postResponse, err := s.httpClient.Post(dashboardDataEndpoint, "application/json", bytes.NewReader(resultBytes))
 	if err != nil {
 		return err
 	}
@@ -92,20 +232,65 @@ func (s *smokeTestProgram) publish(results []SmokeTestResult) error {
 type TestPart func() (interface{}, error)
 
 func RunTestPart(testPart TestPart, testName string, results *[]SmokeTestResult) (interface{}, bool) {
-	obj, err := testPart()
-	if err != nil {
-		fmt.Println(err.Error())
-		*results = append(*results, SmokeTestResult{Name: testName, Result: false, Error: err.Error()})
+	var obj interface{}
+	result := runStep(testName, func(*SmokeTestResult) (err error) {
+		obj, err = testPart()
+		return err
+	})
+	*results = append(*results, result)
+	if !result.Result {
 		return nil, false
 	}
-	*results = append(*results, SmokeTestResult{Name: testName, Result: true})
 	return obj, true
 }
 
+// panicError logs the stack trace of a recovered panic and returns the panic as an error. It must be
+// called from the deferred function that recovered.
+func panicError(r interface{}) error {
+	log.Printf("Recovered from panic: %v\n%s", r, debug.Stack())
+	return fmt.Errorf("panic: %v", r)
+}
+
+// brokenTest takes the place of a test of which the constructor panicked.
+type brokenTest struct {
+	key  string
+	name string
+	err  error
+}
+
+// recoverTestNew is deferred by test constructors. A panic while reading the service binding results in a
+// test that reports the panic instead of crashing the app.
+func recoverTestNew(test *SmokeTest, key, name string) {
+	if r := recover(); r != nil {
+		*test = &brokenTest{key: key, name: name, err: panicError(r)}
+	}
+}
+
+func (b *brokenTest) run() SmokeTestResult {
+	results := []SmokeTestResult{{Name: "Initialize", Result: false, Error: b.err.Error()}}
+	return OverallResult(b.key, b.name, results)
+}
+
+func (b *brokenTest) describe() (string, string) {
+	return b.key, b.name
+}
+
+// OverallResult combines the results of the steps of a test. A test that passed with degraded steps is
+// degraded, and its details name those steps, so the dashboard can show why.
 func OverallResult(key, name string, results []SmokeTestResult) SmokeTestResult {
 	overallResult := true
+	var degraded []string
 	for _, res := range results {
 		overallResult = overallResult && res.Result
+		if res.Degraded {
+			degraded = append(degraded, res.Name+": "+res.Error)
+		}
+	}
+
+	result := SmokeTestResult{Key: key, Name: name, Result: overallResult, Results: results}
+	if overallResult && len(degraded) > 0 {
+		result.Degraded = true
+		result.Details = "Degraded: " + strings.Join(degraded, "; ")
 	}
-	return SmokeTestResult{Key: key, Name: name, Result: overallResult, Results: results}
+	return result
 }
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	sqlTestBinding       = "Read service binding"
+	sqlTestConnection    = "Open connection"
+	sqlTestPrepareCreate = "Prepare create table"
+	sqlTestCreate        = "Create table"
+	sqlTestPrepareInsert = "Prepare insert record"
+	sqlTestInsert        = "Insert record"
+	sqlTestSelect        = "Select records"
+	sqlTestPrepareDelete = "Prepare delete record"
+	sqlTestDelete        = "Delete record"
+	sqlTestTLS           = "TLS connection"
+	sqlTestConnections   = "Connection headroom"
+)
+
+// sqlDialect describes how to talk to a SQL service through database/sql. Supporting another SQL service only
+// needs a new dialect.
+type sqlDialect struct {
+	// driver is the name under which the database/sql driver is registered.
+	driver string
+	// createTable creates the smoketests table (name, created) if it does not exist.
+	createTable string
+	// createCanaryTable creates the smoketests_canary table (name, payload) if it does not exist. Its records
+	// are never swept.
+	createCanaryTable string
+	// bind returns the placeholder of the n-th (1-based) parameter of a statement.
+	bind func(n int) string
+	// connections returns the number of connections in use and the maximum number of connections clients
+	// can open.
+	connections func(db *sql.DB) (used, max int, err error)
+}
+
+// questionMarkBind uses ? placeholders.
+func questionMarkBind(int) string {
+	return "?"
+}
+
+// dollarBind uses $1, $2, ... placeholders.
+func dollarBind(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (d *sqlDialect) insertRecord() string {
+	return fmt.Sprintf("INSERT INTO smoketests(name, created) VALUES(%s, %s)", d.bind(1), d.bind(2))
+}
+
+func (d *sqlDialect) selectRecord() string {
+	return fmt.Sprintf("SELECT name, created FROM smoketests WHERE name = %s", d.bind(1))
+}
+
+func (d *sqlDialect) countRecord() string {
+	return fmt.Sprintf("SELECT COUNT(*) FROM smoketests WHERE name = %s", d.bind(1))
+}
+
+func (d *sqlDialect) deleteRecord() string {
+	return fmt.Sprintf("DELETE FROM smoketests WHERE name = %s", d.bind(1))
+}
+
+func (d *sqlDialect) deleteRecordsBefore() string {
+	return fmt.Sprintf("DELETE FROM smoketests WHERE created < %s", d.bind(1))
+}
+
+// sqlCheck is an additional step of a SQL test, e.g. a check of the health of the cluster behind the service.
+// Checks run once the database could be reached, and after the steps they depend on.
+type sqlCheck struct {
+	name      string
+	dependsOn []string
+	run       func(run *sqlRun, result *SmokeTestResult) error
+}
+
+// sqlRun is what a check knows about the run of a SQL test.
+type sqlRun struct {
+	db *sql.DB
+	// record is the name of the record the run inserts.
+	record  string
+	created time.Time
+}
+
+// sqlTLSCheck reports on the TLS connection to the database. The observer must belong to the TLS
+// configuration the driver connects with.
+func sqlTLSCheck(observer *tlsObserver, expiryWarning time.Duration) sqlCheck {
+	return sqlCheck{name: sqlTestTLS, run: func(run *sqlRun, result *SmokeTestResult) error {
+		if err := run.db.Ping(); err != nil {
+			return err
+		}
+		state, ok := observer.last()
+		if !ok {
+			return errors.New("No TLS connection was made")
+		}
+		return tlsReport(state, expiryWarning, result)
+	}}
+}
+
+// sqlTLSConfig returns the TLS configuration for a database connection when TLS is required: when the
+// binding supplies a CA certificate or DB_TLS_REQUIRED is set. The returned check reports on the connection.
+func sqlTLSConfig(config SmokeTestConfig, creds map[string]interface{}, serverName string) (*tls.Config, []sqlCheck, error) {
+	caCert := bindingCACert(creds)
+	if caCert == "" && !config.DBTLSRequired {
+		return nil, nil, nil
+	}
+
+	tlsConfig, err := newTLSConfig(config, caCert)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.ServerName = serverName
+
+	observer, tlsConfig := tlsObserverNew(tlsConfig)
+	return tlsConfig, []sqlCheck{sqlTLSCheck(observer, config.TLSExpiryWarning)}, nil
+}
+
+// sqlCanaryStore keeps the canary in the smoketests_canary table.
+type sqlCanaryStore struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+func (s *sqlCanaryStore) read() (string, bool, error) {
+	if _, err := s.db.Exec(s.dialect.createCanaryTable); err != nil {
+		return "", false, err
+	}
+
+	var payload string
+	err := s.db.QueryRow(fmt.Sprintf("SELECT payload FROM smoketests_canary WHERE name = %s", s.dialect.bind(1)), canaryName).Scan(&payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return payload, err == nil, err
+}
+
+func (s *sqlCanaryStore) write(payload string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM smoketests_canary WHERE name = %s", s.dialect.bind(1)), canaryName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO smoketests_canary(name, payload) VALUES(%s, %s)", s.dialect.bind(1), s.dialect.bind(2)), canaryName, payload); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlCanaryCheck verifies the canary of a SQL service.
+func sqlCanaryCheck(key string, dialect *sqlDialect) sqlCheck {
+	c := canaryNew(key)
+	return sqlCheck{name: canaryTest, run: func(run *sqlRun, result *SmokeTestResult) error {
+		return c.check(&sqlCanaryStore{db: run.db, dialect: dialect}, result)
+	}}
+}
+
+// sqlConnectionsCheck reports the connection headroom of the service and degrades when more than
+// degradePercent of the connections is in use.
+func sqlConnectionsCheck(dialect *sqlDialect, degradePercent int) sqlCheck {
+	return sqlCheck{name: sqlTestConnections, run: func(run *sqlRun, result *SmokeTestResult) error {
+		used, max, err := dialect.connections(run.db)
+		if err != nil {
+			return err
+		}
+		if max <= 0 {
+			return fmt.Errorf("Invalid maximum number of connections %d", max)
+		}
+
+		usage := 100 * float64(used) / float64(max)
+		result.Metrics = map[string]float64{
+			"connectionsUsed":        float64(used),
+			"connectionsMax":         float64(max),
+			"connectionHeadroom":     float64(max - used),
+			"connectionUsagePercent": usage,
+		}
+		result.Details = fmt.Sprintf("%d of %d connections in use (%.0f%%)", used, max, usage)
+
+		if usage > float64(degradePercent) {
+			return degraded("%d of %d connections in use, more than %d%%", used, max, degradePercent)
+		}
+		return nil
+	}}
+}
+
+// sqlTest writes a record with values unique to the run, reads it back, checks that it round-tripped and
+// deletes it again.
+type sqlTest struct {
+	key     string
+	name    string
+	dialect *sqlDialect
+	// host is only used to check the service binding.
+	host           string
+	dataSourceName string
+	checks         []sqlCheck
+}
+
+func sqlTestNew(config SmokeTestConfig, key, name string, dialect *sqlDialect, host, dataSourceName string, checks ...sqlCheck) *sqlTest {
+	checks = append([]sqlCheck{sqlCanaryCheck(key, dialect), sqlConnectionsCheck(dialect, config.DBConnectionDegradePercent)}, checks...)
+	return &sqlTest{
+		key:            key,
+		name:           name,
+		dialect:        dialect,
+		host:           host,
+		dataSourceName: dataSourceName,
+		checks:         append(sqlTransactionChecks(dialect), checks...),
+	}
+}
+
+func (t *sqlTest) run() SmokeTestResult {
+	var db *sql.DB
+	var createTableStmt, insertStmt, deleteStmt *sql.Stmt
+	defer func() {
+		for _, stmt := range []*sql.Stmt{createTableStmt, insertStmt, deleteStmt} {
+			if stmt != nil {
+				stmt.Close()
+			}
+		}
+		if db != nil {
+			db.Close()
+		}
+	}()
+
+	created := time.Now()
+	record := sqlRecordName(created)
+
+	plan := testPlanNew(t.key, t.name)
+
+	// Check service binding.
+	plan.step(sqlTestBinding, func(*SmokeTestResult) error {
+		fmt.Printf("found %s hostname: %s\n", t.name, t.host)
+		if t.host == "" {
+			return fmt.Errorf("No %s hostname found in VCAP_SERVICES", t.name)
+		}
+		return nil
+	})
+
+	plan.step(sqlTestConnection, func(*SmokeTestResult) (err error) {
+		db, err = sql.Open(t.dialect.driver, t.dataSourceName)
+		return err
+	}, sqlTestBinding)
+
+	plan.step(sqlTestPrepareCreate, func(*SmokeTestResult) (err error) {
+		createTableStmt, err = db.Prepare(t.dialect.createTable)
+		return err
+	}, sqlTestConnection)
+
+	plan.step(sqlTestCreate, func(*SmokeTestResult) error {
+		_, err := createTableStmt.Exec()
+		return err
+	}, sqlTestPrepareCreate)
+
+	plan.step(sqlTestPrepareInsert, func(*SmokeTestResult) (err error) {
+		insertStmt, err = db.Prepare(t.dialect.insertRecord())
+		return err
+	}, sqlTestCreate)
+
+	plan.step(sqlTestInsert, func(*SmokeTestResult) error {
+		_, err := insertStmt.Exec(record, created.Unix())
+		return err
+	}, sqlTestPrepareInsert)
+
+	// The record must come back exactly as it was written.
+	plan.step(sqlTestSelect, func(*SmokeTestResult) error {
+		rows, err := db.Query(t.dialect.selectRecord(), record)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		found := 0
+		for rows.Next() {
+			var name string
+			var createdUnix int64
+			if err := rows.Scan(&name, &createdUnix); err != nil {
+				return err
+			}
+			if name != record || createdUnix != created.Unix() {
+				return fmt.Errorf("Record did not round-trip: wrote (%s, %d), read (%s, %d)", record, created.Unix(), name, createdUnix)
+			}
+			found++
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if found != 1 {
+			return fmt.Errorf("Expected 1 record named %s, found %d", record, found)
+		}
+		return nil
+	}, sqlTestInsert)
+
+	plan.step(sqlTestPrepareDelete, func(*SmokeTestResult) (err error) {
+		deleteStmt, err = db.Prepare(t.dialect.deleteRecord())
+		return err
+	}, sqlTestCreate)
+
+	plan.cleanup(sqlTestDelete, func(*SmokeTestResult) error {
+		res, err := deleteStmt.Exec(record)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n != 1 {
+			return fmt.Errorf("Expected to delete 1 record, deleted %d", n)
+		}
+		return nil
+	}, sqlTestInsert, sqlTestPrepareDelete)
+
+	for _, check := range t.checks {
+		check := check
+		plan.step(check.name, func(result *SmokeTestResult) error {
+			return check.run(&sqlRun{db: db, record: record, created: created}, result)
+		}, append([]string{sqlTestPrepareCreate}, check.dependsOn...)...)
+	}
+
+	return plan.run()
+}
+
+func (t *sqlTest) describe() (string, string) {
+	return t.key, t.name
+}
+
+// sweep deletes records left behind by interrupted runs.
+func (t *sqlTest) sweep(createdBefore time.Time) ([]string, error) {
+	if t.host == "" {
+		return nil, nil
+	}
+
+	db, err := sql.Open(t.dialect.driver, t.dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if _, err = db.Exec(t.dialect.createTable); err != nil {
+		return nil, err
+	}
+	res, err := db.Exec(t.dialect.deleteRecordsBefore(), createdBefore.Unix())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return []string{fmt.Sprintf("%d %s record(s)", n, t.name)}, nil
+	}
+	return nil, nil
+}
+
+// sqlRecordName returns a record name that is unique to the run, also when several apps share a database.
+func sqlRecordName(created time.Time) string {
+	return fmt.Sprintf("%s-%09d", resourceName(smokeTestResourcePrefix, created), created.Nanosecond())
+}
+
+// sqlRow returns the first row of a query by column name, e.g. of SHOW SLAVE STATUS. Found is false when the
+// query returned no rows.
+func sqlRow(db *sql.DB, query string, args ...interface{}) (row map[string]string, found bool, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, false, err
+	}
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+
+	values := make([]sql.NullString, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, false, err
+	}
+
+	row = make(map[string]string, len(columns))
+	for i, column := range columns {
+		row[column] = values[i].String
+	}
+	return row, true, nil
+}
+
+// sqlVariables returns the name/value rows of a query, e.g. of SHOW GLOBAL STATUS.
+func sqlVariables(db *sql.DB, query string, args ...interface{}) (map[string]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variables := make(map[string]string)
+	for rows.Next() {
+		var name, value sql.NullString
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		variables[name.String] = value.String
+	}
+	return variables, rows.Err()
+}
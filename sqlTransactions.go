@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	sqlTestTxBegin     = "Write in transaction"
+	sqlTestTxIsolation = "Uncommitted write invisible"
+	sqlTestTxRollback  = "Roll back transaction"
+	sqlTestTxCommit    = "Commit transaction"
+)
+
+// sqlTransactions checks that transactions behave: a write is invisible to other connections until it is
+// committed, and gone after a rollback. Proxies and poolers in front of a database can silently break this,
+// e.g. PgBouncer in statement mode.
+type sqlTransactions struct {
+	dialect *sqlDialect
+
+	// The transaction of the current run, from the write until the rollback.
+	tx *sql.Tx
+}
+
+func sqlTransactionChecks(dialect *sqlDialect) []sqlCheck {
+	t := &sqlTransactions{dialect: dialect}
+	return []sqlCheck{
+		{name: sqlTestTxBegin, dependsOn: []string{sqlTestCreate}, run: t.begin},
+		{name: sqlTestTxIsolation, dependsOn: []string{sqlTestTxBegin}, run: t.isolation},
+		{name: sqlTestTxRollback, dependsOn: []string{sqlTestTxBegin}, run: t.rollback},
+		{name: sqlTestTxCommit, dependsOn: []string{sqlTestCreate}, run: t.commit},
+	}
+}
+
+// count counts the records with the given name on a connection other than the one of the transaction: the
+// transaction holds its connection until it ends.
+func (t *sqlTransactions) count(db *sql.DB, name string) (int, error) {
+	var count int
+	err := db.QueryRow(t.dialect.countRecord(), name).Scan(&count)
+	return count, err
+}
+
+// begin writes a record in a transaction that is kept open for the next steps. When the step fails, the
+// transaction is rolled back right away, as the rollback step is skipped.
+func (t *sqlTransactions) begin(run *sqlRun, result *SmokeTestResult) (err error) {
+	tx, err := run.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		t.tx = tx
+	}()
+
+	if _, err := tx.Exec(t.dialect.insertRecord(), run.record+"-rollback", run.created.Unix()); err != nil {
+		return err
+	}
+
+	var count int
+	if err := tx.QueryRow(t.dialect.countRecord(), run.record+"-rollback").Scan(&count); err != nil {
+		return err
+	}
+	if count != 1 {
+		return fmt.Errorf("Write not visible within its own transaction")
+	}
+	return nil
+}
+
+func (t *sqlTransactions) isolation(run *sqlRun, result *SmokeTestResult) error {
+	count, err := t.count(run.db, run.record+"-rollback")
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return fmt.Errorf("Uncommitted write is visible to another connection")
+	}
+	return nil
+}
+
+func (t *sqlTransactions) rollback(run *sqlRun, result *SmokeTestResult) error {
+	tx := t.tx
+	t.tx = nil
+	if err := tx.Rollback(); err != nil {
+		return err
+	}
+
+	count, err := t.count(run.db, run.record+"-rollback")
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return fmt.Errorf("Write is still there after rollback")
+	}
+	return nil
+}
+
+// commit writes in a transaction, commits and checks that the write is visible to another connection. The
+// record is deleted again; the sweeper removes it should that fail.
+func (t *sqlTransactions) commit(run *sqlRun, result *SmokeTestResult) error {
+	name := run.record + "-commit"
+
+	tx, err := run.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(t.dialect.insertRecord(), name, run.created.Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	defer run.db.Exec(t.dialect.deleteRecord(), name)
+
+	count, err := t.count(run.db, name)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return fmt.Errorf("Committed write is not visible to another connection")
+	}
+	return nil
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
 )
 
 const (
-	uaaSmokeUsername = "smokeuser"
-	uaaSmokePassword = "smokepassword"
-	smokeScope       = "smoketest.extinguish"
+	uaaSmokeUsernamePrefix = "smokeuser-"
+	uaaSmokePassword       = "smokepassword"
+	smokeScope             = "smoketest.extinguish"
 
 	ssoKey  = "sso"
 	ssoName = "Single Sign-On"
@@ -19,7 +22,6 @@ const (
 	ssoErrorBinding          = "Service p-identity not or incorrectly configured in VCAP_SERVICES"
 	ssoTestClientCredentials = "Client credentials grant"
 	ssoTestCreateUser        = "Create local user"
-	ssoTestGetUser           = "Get local user"
 	ssoTestGetGroups         = "Get local groups/scopes"
 	ssoTestAddGroupMember    = "Add local user to group"
 	ssoTestPassword          = "Resource owner password credentials grant"
@@ -43,9 +45,12 @@ type ssoTest struct {
 	authDomain   string
 	clientId     string
 	clientSecret string
+	httpClient   *http.Client
 }
 
-func ssoTestNew(env *cfenv.App) SmokeTest {
+func ssoTestNew(env *cfenv.App, config SmokeTestConfig) (test SmokeTest) {
+	defer recoverTestNew(&test, ssoKey, ssoName)
+
 	adfsResourceUrl = os.Getenv("ADFS_RES_URL")
 	uaaResourceUrl = os.Getenv("UAA_RES_URL")
 
@@ -53,148 +58,110 @@ func ssoTestNew(env *cfenv.App) SmokeTest {
 		return nil
 	}
 
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		fmt.Println("Unable to create http client for UAA: " + err.Error())
+		return nil
+	}
+
 	identityServices, err := env.Services.WithLabel("p-identity")
 	if err != nil {
-		return &ssoTest{"", "", ""}
+		return &ssoTest{httpClient: httpClient}
 	}
 
 	creds := identityServices[0].Credentials
 	return &ssoTest{
-		creds["auth_domain"].(string),
-		creds["client_id"].(string),
-		creds["client_secret"].(string),
+		authDomain:   creds["auth_domain"].(string),
+		clientId:     creds["client_id"].(string),
+		clientSecret: creds["client_secret"].(string),
+		httpClient:   httpClient,
 	}
 
 }
 
-func (t *ssoTest) run() SmokeTestResult {
-	results := make([]SmokeTestResult, 0)
-	oauth2FlowsTestResult := t.internalRun()
-
-	// Transform test results into SmokeTestResult structure.
-	if oauth2FlowsTestResult.ServiceBindingError {
-		results = append(results, SmokeTestResult{Name: ssoTestBinding, Result: false, Error: ssoErrorBinding})
-		return OverallResult(ssoKey, ssoName, results)
+// ssoSweeperNew returns a sweeper for the users of the identity service binding, or nil when the app isn't
+// bound to it. Unlike the test, it doesn't need the ADFS and UAA resource URLs.
+func ssoSweeperNew(env *cfenv.App, config SmokeTestConfig) Sweeper {
+	identityServices, err := env.Services.WithLabel("p-identity")
+	if err != nil {
+		return nil
 	}
-	results = append(results, SmokeTestResult{Name: ssoTestBinding, Result: true})
 
-	clientCredentials := oauth2FlowsTestResult.ClientCredentials
-	results = append(results, SmokeTestResult{Name: ssoTestClientCredentials, Result: clientCredentials.Result, Error: clientCredentials.Error, ErrorDescription: clientCredentials.ErrorDescription, StatusCode: clientCredentials.StatusCode})
-	if clientCredentials.HasError() {
-		return OverallResult(ssoKey, ssoName, results)
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		fmt.Println("Unable to create http client for UAA: " + err.Error())
+		return nil
 	}
 
-	createUser := oauth2FlowsTestResult.CreateUser
-	results = append(results, SmokeTestResult{Name: ssoTestCreateUser, Result: createUser.Result, Error: createUser.Error, ErrorDescription: createUser.ErrorDescription, StatusCode: createUser.StatusCode})
-	if createUser.HasError() {
-		return OverallResult(ssoKey, ssoName, results)
-	}
+	creds := identityServices[0].Credentials
+	authDomain, _ := creds["auth_domain"].(string)
+	clientId, _ := creds["client_id"].(string)
+	clientSecret, _ := creds["client_secret"].(string)
+	return &ssoTest{authDomain: authDomain, clientId: clientId, clientSecret: clientSecret, httpClient: httpClient}
+}
 
-	if getUser := oauth2FlowsTestResult.GetUser; getUser != nil {
-		results = append(results, SmokeTestResult{Name: ssoTestGetUser, Result: getUser.Result, Error: getUser.Error, ErrorDescription: getUser.ErrorDescription, StatusCode: getUser.StatusCode})
-		if getUser.HasError() {
-			return OverallResult(ssoKey, ssoName, results)
-		}
-	}
+func (t *ssoTest) run() SmokeTestResult {
+	var accessToken string
+	var createdUser *ScimResource
+	var groups []ScimResource
+	username := resourceName(uaaSmokeUsernamePrefix, time.Now())
 
-	if getGroups := oauth2FlowsTestResult.GetGroups; getGroups != nil {
-		results = append(results, SmokeTestResult{Name: ssoTestGetGroups, Result: getGroups.Result, Error: getGroups.Error, ErrorDescription: getGroups.ErrorDescription, StatusCode: getGroups.StatusCode})
-		if getGroups.HasError() {
-			return OverallResult(ssoKey, ssoName, results)
-		}
-	}
+	plan := testPlanNew(ssoKey, ssoName)
 
-	if addGroupMember := oauth2FlowsTestResult.AddGroupMember; addGroupMember != nil {
-		results = append(results, SmokeTestResult{Name: ssoTestAddGroupMember, Result: addGroupMember.Result, Error: addGroupMember.Error, ErrorDescription: addGroupMember.ErrorDescription, StatusCode: addGroupMember.StatusCode})
-		if addGroupMember.HasError() {
-			return OverallResult(ssoKey, ssoName, results)
+	plan.step(ssoTestBinding, func(*SmokeTestResult) error {
+		fmt.Println("Found client_id: " + t.clientId)
+		if t.clientId == "" {
+			return errors.New(ssoErrorBinding)
 		}
-	}
+		return nil
+	})
 
-	if passwordGrant := oauth2FlowsTestResult.Password; passwordGrant != nil {
-		results = append(results, SmokeTestResult{Name: ssoTestPassword, Result: passwordGrant.Result, Error: passwordGrant.Error, ErrorDescription: passwordGrant.ErrorDescription, StatusCode: passwordGrant.StatusCode})
-		if passwordGrant.HasError() {
-			return OverallResult(ssoKey, ssoName, results)
-		}
-	}
+	// Authenticate against UAA using client_credentials grant type and provided client id and secret.
+	plan.step(ssoTestClientCredentials, func(result *SmokeTestResult) error {
+		tokenResponse, testResult := ClientCredentialsAuthentication(t.httpClient, t.clientId, t.clientSecret, t.authDomain)
+		accessToken = tokenResponse.AccessToken
+		return testResult.report(result)
+	}, ssoTestBinding)
 
-	if adfsAuthCode := oauth2FlowsTestResult.AuthorizationCodeADFS; adfsAuthCode != nil {
-		results = append(results, SmokeTestResult{Name: ssoTestAuthCodeADFS, Result: adfsAuthCode.Result, Error: adfsAuthCode.Error, ErrorDescription: adfsAuthCode.ErrorDescription, StatusCode: adfsAuthCode.StatusCode})
-		if adfsAuthCode.HasError() {
-			return OverallResult(ssoKey, ssoName, results)
+	// Create a local user, authenticating with the token we acquired above (which should have scim.write scope).
+	// SCIM stands for System for Cross-domain Identity Management (http://www.simplecloud.info/). A user that
+	// already exists is looked up instead.
+	plan.step(ssoTestCreateUser, func(result *SmokeTestResult) error {
+		user := ScimUser{
+			UserName:     username,
+			Name:         ScimUserName{Formatted: "Smoke User", FamilyName: "User", GivenName: "Smoke"},
+			Emails:       []ScimAttribute{{Value: "smokeuser@smoke.itq.nl"}},
+			Active:       true,
+			Verified:     true,
+			Origin:       "uaa",
+			Password:     uaaSmokePassword,
+			ScimResource: ScimResource{ExternalID: "", Meta: nil, Scim: Scim{Schemas: []string{"urn:scim:schemas:core:1.0"}}},
 		}
-	}
-
-	/*	if uaaAuthCode := oauth2FlowsTestResult.AuthorizationCodeUAA; uaaAuthCode != nil {
-			results = append(results, SmokeTestResult{Name: ssoTestAuthCodeUAA, Result: uaaAuthCode.Result, Error: uaaAuthCode.Error, ErrorDescription: uaaAuthCode.ErrorDescription, StatusCode: uaaAuthCode.StatusCode})
-			if uaaAuthCode.HasError() {
-				return OverallResult(ssoKey, ssoName, results)
+		var createResult, getResult *TestResult
+		createdUser, createResult, getResult = CreateOrGetUser(t.httpClient, user, accessToken, t.authDomain)
+		if err := createResult.report(result); err != nil {
+			return err
+		}
+		if getResult != nil {
+			if err := getResult.report(result); err != nil {
+				return err
 			}
 		}
-	*/
-	fmt.Printf("DeleteUser: %v\n", oauth2FlowsTestResult.DeleteUser)
-	if deleteUser := oauth2FlowsTestResult.DeleteUser; deleteUser != nil {
-		results = append(results, SmokeTestResult{Name: ssoTestDeleteUser, Result: deleteUser.Result, Error: deleteUser.Error, ErrorDescription: deleteUser.ErrorDescription, StatusCode: deleteUser.StatusCode})
-		if deleteUser.HasError() {
-			return OverallResult(ssoKey, ssoName, results)
+		if createdUser == nil {
+			return errors.New("No user created")
 		}
-	}
-
-	return OverallResult(ssoKey, ssoName, results)
-}
-
-func (t *ssoTest) internalRun() Oauth2FlowsTestResult {
-	oauth2FlowsTestResult := &Oauth2FlowsTestResult{}
-
-	fmt.Println("Found client_id: " + t.clientId)
-	if t.clientId == "" {
-		fmt.Println("No client_id found")
-		oauth2FlowsTestResult.ServiceBindingError = true
-		return *oauth2FlowsTestResult
-	}
-
-	// Authenticate against UAA using client_credentials grant type and provided client id and secret.
-	clientCredentialsTokenResponse, clientCredentialsTestResult := ClientCredentialsAuthentication(t.clientId, t.clientSecret, t.authDomain)
-	oauth2FlowsTestResult.ClientCredentials = &clientCredentialsTestResult
-	if clientCredentialsTestResult.HasError() {
-		return *oauth2FlowsTestResult
-	}
-
-	// Create a local user, authenticating with the token we acquired above (which should have scim.write scope).
-	// SCIM stands for System for Cross-domain Identity Management (http://www.simplecloud.info/).
-	user := ScimUser{
-		UserName:     uaaSmokeUsername,
-		Name:         ScimUserName{Formatted: "Smoke User", FamilyName: "User", GivenName: "Smoke"},
-		Emails:       []ScimAttribute{{Value: "smokeuser@smoke.itq.nl"}},
-		Active:       true,
-		Verified:     true,
-		Origin:       "uaa",
-		Password:     uaaSmokePassword,
-		ScimResource: ScimResource{ExternalID: "", Meta: nil, Scim: Scim{Schemas: []string{"urn:scim:schemas:core:1.0"}}},
-	}
-	createdUser, createUserTestResult, getUserTestResult := CreateOrGetUser(user, clientCredentialsTokenResponse.AccessToken, t.authDomain)
-	oauth2FlowsTestResult.CreateUser = createUserTestResult
-	oauth2FlowsTestResult.GetUser = getUserTestResult
-	if createUserTestResult.HasError() || (getUserTestResult != nil && getUserTestResult.HasError()) {
-		return *oauth2FlowsTestResult
-	}
+		return nil
+	}, ssoTestClientCredentials)
 
-	if createdUser != nil {
-		// Delete local user after we're finished (via defer).
-		defer func(res *Oauth2FlowsTestResult) {
-			deleteUserTestResult := DeleteUser(createdUser.ID, clientCredentialsTokenResponse.AccessToken, t.authDomain)
-			fmt.Printf("Delete user: %v\n", deleteUserTestResult)
-			res.DeleteUser = &deleteUserTestResult
-		}(oauth2FlowsTestResult)
-
-		// Get all groups (to be able to assign new user to groups).
-		groups, getGroupsResult := GetGroups(clientCredentialsTokenResponse.AccessToken, t.authDomain)
-		oauth2FlowsTestResult.GetGroups = &getGroupsResult
-		if getGroupsResult.HasError() {
-			return *oauth2FlowsTestResult
-		}
+	// Get all groups (to be able to assign new user to groups).
+	plan.step(ssoTestGetGroups, func(result *SmokeTestResult) error {
+		var testResult TestResult
+		groups, testResult = GetGroups(t.httpClient, accessToken, t.authDomain)
+		return testResult.report(result)
+	}, ssoTestCreateUser)
 
-		// Get smoketest.extinguish group.
+	// Assign user to smoketest.extinguish group.
+	plan.step(ssoTestAddGroupMember, func(result *SmokeTestResult) error {
 		var smokeExtinguishGroup ScimResource
 		for i := range groups {
 			if groups[i].DisplayName == smokeScope {
@@ -202,53 +169,74 @@ func (t *ssoTest) internalRun() Oauth2FlowsTestResult {
 				break
 			}
 		}
+		testResult := AddGroupMember(t.httpClient, smokeExtinguishGroup.ID, createdUser.ID, accessToken, t.authDomain)
+		return testResult.report(result)
+	}, ssoTestGetGroups)
+
+	// Authenticate directly against UAA with newly created user using password grant type.
+	// (https://tools.ietf.org/html/rfc6749#section-4.3)
+	// This does not involve ADFS yet, goes directly to UAA.
+	plan.step(ssoTestPassword, func(result *SmokeTestResult) error {
+		_, testResult := PasswordAuthentication(t.httpClient, t.clientId, t.clientSecret, t.authDomain, username, uaaSmokePassword)
+		return testResult.report(result)
+	}, ssoTestAddGroupMember)
+
+	// Authenticate against ADFS using the authorization code grant type (https://tools.ietf.org/html/rfc6749#section-4.1).
+	plan.step(ssoTestAuthCodeADFS, func(result *SmokeTestResult) error {
+		_, testResult := AdfsAuthorizationCodeAuthentication(t.httpClient, adfsSmokeUsername, adfsSmokePassword)
+		return testResult.report(result)
+	}, ssoTestPassword)
+
+	/*
+		// Authenticate against UAA using the authorization code grant type (https://tools.ietf.org/html/rfc6749#section-4.1).
+		// Does still not involve ADFS yet. This requires an application that is protected by a UAA client.
+		plan.step(ssoTestAuthCodeUAA, func(result *SmokeTestResult) error {
+			_, testResult := UaaAuthorizationCodeAuthentication(t.httpClient, username, uaaSmokePassword)
+			return testResult.report(result)
+		}, ssoTestPassword)
+	*/
 
-		// Assign user to smoketest.extinguish group.
-		addMemberResult := AddGroupMember(smokeExtinguishGroup.ID, createdUser.ID, clientCredentialsTokenResponse.AccessToken, t.authDomain)
-		oauth2FlowsTestResult.AddGroupMember = &addMemberResult
-		if addMemberResult.HasError() {
-			return *oauth2FlowsTestResult
-		}
+	// Delete local user after we're finished.
+	plan.cleanup(ssoTestDeleteUser, func(result *SmokeTestResult) error {
+		testResult := DeleteUser(t.httpClient, createdUser.ID, accessToken, t.authDomain)
+		return testResult.report(result)
+	}, ssoTestCreateUser)
 
-		// Authenticate directly against UAA with newly created user using password grant type.
-		// (https://tools.ietf.org/html/rfc6749#section-4.3)
-		// This does not involve ADFS yet, goes directly to UAA.
-		_, userTokenTestResult := PasswordAuthentication(t.clientId, t.clientSecret, t.authDomain, uaaSmokeUsername, uaaSmokePassword)
-		oauth2FlowsTestResult.Password = &userTokenTestResult
-		if userTokenTestResult.HasError() {
-			return *oauth2FlowsTestResult
-		}
+	return plan.run()
+}
 
-		// Authenticate against ADFS using the authorization code grant type (https://tools.ietf.org/html/rfc6749#section-4.1).
-		_, adfsAuthorizationCodeResult := AdfsAuthorizationCodeAuthentication(adfsSmokeUsername, adfsSmokePassword)
-		oauth2FlowsTestResult.AuthorizationCodeADFS = &adfsAuthorizationCodeResult
-		if adfsAuthorizationCodeResult.HasError() {
-			return *oauth2FlowsTestResult
-		}
+func (t *ssoTest) describe() (string, string) {
+	return ssoKey, ssoName
+}
 
-		/*
-			// Authenticate against UAA using the authorization code grant type (https://tools.ietf.org/html/rfc6749#section-4.1).
-			// Does still not involve ADFS yet. This requires an application that is protected by a UAA client.
-			_, uaaAuthorizationCodeResult := UaaAuthorizationCodeAuthentication(uaaSmokeUsername, uaaSmokePassword)
-			oauth2FlowsTestResult.AuthorizationCodeUAA = &uaaAuthorizationCodeResult
-			if uaaAuthorizationCodeResult.HasError() {
-				return *oauth2FlowsTestResult
-			}
-		*/
+// sweep deletes local users left behind by interrupted runs.
+func (t *ssoTest) sweep(createdBefore time.Time) ([]string, error) {
+	if t.clientId == "" {
+		return nil, nil
 	}
 
-	return *oauth2FlowsTestResult
-}
+	tokenResponse, tokenResult := ClientCredentialsAuthentication(t.httpClient, t.clientId, t.clientSecret, t.authDomain)
+	if tokenResult.HasError() {
+		return nil, fmt.Errorf("Unable to authenticate to UAA: %s %s", tokenResult.Error, tokenResult.ErrorDescription)
+	}
+
+	users, err := GetUsersByPrefix(t.httpClient, tokenResponse.AccessToken, t.authDomain, uaaSmokeUsernamePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, user := range users {
+		created, ok := resourceCreated(uaaSmokeUsernamePrefix, user.UserName)
+		if !ok || !created.Before(createdBefore) {
+			continue
+		}
+		if deleteResult := DeleteUser(t.httpClient, user.ID, tokenResponse.AccessToken, t.authDomain); deleteResult.HasError() {
+			err = fmt.Errorf("Unable to delete user %s: %s %s", user.UserName, deleteResult.Error, deleteResult.ErrorDescription)
+			continue
+		}
+		removed = append(removed, "UAA user "+user.UserName)
+	}
 
-type Oauth2FlowsTestResult struct {
-	ServiceBindingError   bool        `json:"serviceBindingError"`
-	ClientCredentials     *TestResult `json:"clientCredentials,omitempty"`
-	CreateUser            *TestResult `json:"createUser,omitempty"`
-	GetUser               *TestResult `json:"getUser,omitempty"`
-	GetGroups             *TestResult `json:"getGroups,omitempty"`
-	AddGroupMember        *TestResult `json:"addGroupMemberResult,omitempty"`
-	Password              *TestResult `json:"password,omitempty"`
-	AuthorizationCodeUAA  *TestResult `json:"authCodeUAA,omitempty"`
-	AuthorizationCodeADFS *TestResult `json:"authCodeAdfs,omitempty"`
-	DeleteUser            *TestResult `json:"deleteUser,omitempty"`
+	return removed, err
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 )
 
 type TokenResponse struct {
@@ -40,3 +41,13 @@ func defaultTestResult() TestResult {
 func (r TestResult) HasError() bool {
 	return !r.Result
 }
+
+// report copies the details of a UAA call to the result of a test step and returns an error when it failed.
+func (r TestResult) report(result *SmokeTestResult) error {
+	result.StatusCode = r.StatusCode
+	result.ErrorDescription = r.ErrorDescription
+	if r.HasError() {
+		return errors.New(r.Error)
+	}
+	return nil
+}
@@ -25,7 +25,7 @@ const (
 
 // ClientCredentialsAuthentication performs the OAuth2 client credentials flow against UAA and returns the
 // token and the result of the test.
-func ClientCredentialsAuthentication(clientID, clientSecret, authDomain string) (TokenResponse, TestResult) {
+func ClientCredentialsAuthentication(httpClient *http.Client, clientID, clientSecret, authDomain string) (TokenResponse, TestResult) {
 	authResult := defaultTestResult()
 
 	// Construct OAuth2 client_credentials grant request.
@@ -43,7 +43,6 @@ func ClientCredentialsAuthentication(clientID, clientSecret, authDomain string)
 	clientCredentialsGrantRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	// Execute request.
-	httpClient := &http.Client{}
 	clientCredentialsGrantResponse, err := httpClient.Do(clientCredentialsGrantRequest)
 	if err != nil {
 		panic(err)
@@ -72,7 +71,7 @@ func ClientCredentialsAuthentication(clientID, clientSecret, authDomain string)
 
 // PasswordAuthentication performs the OAuth2 password credentials flow against UAA and returns the
 // JWT token and test result.
-func PasswordAuthentication(clientID, clientSecret, authDomain, username, password string) (TokenResponse, TestResult) {
+func PasswordAuthentication(httpClient *http.Client, clientID, clientSecret, authDomain, username, password string) (TokenResponse, TestResult) {
 	authResult := defaultTestResult()
 
 	// Construct OAuth2 password grant request.
@@ -92,7 +91,6 @@ func PasswordAuthentication(clientID, clientSecret, authDomain, username, passwo
 	passwordGrantRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	// Execute request.
-	httpClient := &http.Client{}
 	passwordGrantResponse, err := httpClient.Do(passwordGrantRequest)
 	if err != nil {
 		panic(err)
@@ -121,12 +119,13 @@ func PasswordAuthentication(clientID, clientSecret, authDomain, username, passwo
 	return tokenResponse, authResult
 }
 
-func UaaAuthorizationCodeAuthentication(uaaSmokeUsername, uaaSmokePassword string) (TokenResponse, TestResult) {
+func UaaAuthorizationCodeAuthentication(baseClient *http.Client, uaaSmokeUsername, uaaSmokePassword string) (TokenResponse, TestResult) {
 	authResult := defaultTestResult()
 
 	// Create http client with cookie jar (otherwise cookies are ignored).
 	cookieJar, _ := cookiejar.New(nil)
-	httpClient := http.Client{Jar: cookieJar}
+	httpClient := *baseClient
+	httpClient.Jar = cookieJar
 
 	// Attempt to access resource that is protected by UAA client application.
 	resp, err := httpClient.Get(uaaResourceUrl)
@@ -205,12 +204,13 @@ func UaaAuthorizationCodeAuthentication(uaaSmokeUsername, uaaSmokePassword strin
 	return TokenResponse{AccessToken: token.AccessToken, TokenType: token.TokenType, RefreshToken: token.RefreshToken, ExpiresIn: int(token.Expiry.Unix())}, authResult
 }
 
-func AdfsAuthorizationCodeAuthentication(adfsSmokeUsername, adfsSmokePassword string) (TokenResponse, TestResult) {
+func AdfsAuthorizationCodeAuthentication(baseClient *http.Client, adfsSmokeUsername, adfsSmokePassword string) (TokenResponse, TestResult) {
 	authResult := defaultTestResult()
 
 	// Create http client with cookie jar (otherwise cookies are ignored).
 	cookieJar, _ := cookiejar.New(nil)
-	httpClient := http.Client{Jar: cookieJar}
+	httpClient := *baseClient
+	httpClient.Jar = cookieJar
 
 	// Attempt to access resource that is protected by UAA client application.
 	resp, err := httpClient.Get(adfsResourceUrl)
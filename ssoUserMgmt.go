@@ -8,7 +8,7 @@ import (
 	"net/url"
 )
 
-func CreateOrGetUser(user ScimUser, jwtToken, authDomain string) (*ScimResource, *TestResult, *TestResult) {
+func CreateOrGetUser(httpClient *http.Client, user ScimUser, jwtToken, authDomain string) (*ScimResource, *TestResult, *TestResult) {
 	createUserResult := defaultTestResult()
 
 	// Marshal user object to JSON bytes.
@@ -28,7 +28,6 @@ func CreateOrGetUser(user ScimUser, jwtToken, authDomain string) (*ScimResource,
 	createUserRequest.Header.Add("Content-Type", "application/json")
 	createUserRequest.Header.Add("Authorization", "Bearer "+jwtToken)
 
-	httpClient := &http.Client{}
 	createUserResponse, err := httpClient.Do(createUserRequest)
 	if err != nil {
 		panic(err)
@@ -65,7 +64,7 @@ func CreateOrGetUser(user ScimUser, jwtToken, authDomain string) (*ScimResource,
 
 			// Attempt to get existing user.
 			var retrievedUser *ScimResource
-			retrievedUser, getUserResult := GetUserByUserName(jwtToken, authDomain, user.UserName)
+			retrievedUser, getUserResult := GetUserByUserName(httpClient, jwtToken, authDomain, user.UserName)
 			return retrievedUser, &createUserResult, &getUserResult
 		}
 	}
@@ -77,7 +76,7 @@ func CreateOrGetUser(user ScimUser, jwtToken, authDomain string) (*ScimResource,
 	return nil, &createUserResult, nil
 }
 
-func GetUserByUserName(jwtToken, authDomain, userName string) (*ScimResource, TestResult) {
+func GetUserByUserName(httpClient *http.Client, jwtToken, authDomain, userName string) (*ScimResource, TestResult) {
 	getUserResult := defaultTestResult()
 
 	// Create request to retrieve specific user by user name.
@@ -90,7 +89,6 @@ func GetUserByUserName(jwtToken, authDomain, userName string) (*ScimResource, Te
 	getUsersRequest.Header.Add("Accept", "application/json")
 	getUsersRequest.Header.Add("Authorization", "Bearer "+jwtToken)
 
-	httpClient := &http.Client{}
 	getUsersResponse, err := httpClient.Do(getUsersRequest)
 	if err != nil {
 		panic(err)
@@ -126,7 +124,37 @@ func GetUserByUserName(jwtToken, authDomain, userName string) (*ScimResource, Te
 	return nil, getUserResult
 }
 
-func GetGroups(jwtToken, authDomain string) ([]ScimResource, TestResult) {
+// GetUsersByPrefix retrieves all users of which the user name starts with the given prefix.
+func GetUsersByPrefix(httpClient *http.Client, jwtToken, authDomain, prefix string) ([]ScimUser, error) {
+	// https://docs.cloudfoundry.org/api/uaa/version/4.8.0/index.html#list-3
+	filter := url.QueryEscape(fmt.Sprintf("userName sw \"%s\"", prefix))
+	getUsersRequest, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/Users?filter=%s", authDomain, filter), nil)
+	if err != nil {
+		return nil, err
+	}
+	getUsersRequest.Header.Add("Accept", "application/json")
+	getUsersRequest.Header.Add("Authorization", "Bearer "+jwtToken)
+
+	getUsersResponse, err := httpClient.Do(getUsersRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer getUsersResponse.Body.Close()
+
+	if statusCode := getUsersResponse.StatusCode; statusCode != http.StatusOK {
+		return nil, fmt.Errorf("Received unexpected status code %d while listing users", statusCode)
+	}
+
+	var users struct {
+		Resources []ScimUser `json:"Resources"`
+	}
+	if err = json.NewDecoder(getUsersResponse.Body).Decode(&users); err != nil {
+		return nil, err
+	}
+	return users.Resources, nil
+}
+
+func GetGroups(httpClient *http.Client, jwtToken, authDomain string) ([]ScimResource, TestResult) {
 	getGroupsResult := defaultTestResult()
 
 	// Create request to retrieve all groups.
@@ -138,7 +166,6 @@ func GetGroups(jwtToken, authDomain string) ([]ScimResource, TestResult) {
 	getGroupsRequest.Header.Add("Accept", "application/json")
 	getGroupsRequest.Header.Add("Authorization", "Bearer "+jwtToken)
 
-	httpClient := &http.Client{}
 	getGroupsResponse, err := httpClient.Do(getGroupsRequest)
 	if err != nil {
 		panic(err)
@@ -163,7 +190,7 @@ func GetGroups(jwtToken, authDomain string) ([]ScimResource, TestResult) {
 	return nil, getGroupsResult
 }
 
-func AddGroupMember(groupID, userID, jwtToken, authDomain string) TestResult {
+func AddGroupMember(httpClient *http.Client, groupID, userID, jwtToken, authDomain string) TestResult {
 	addGroupMemberResult := defaultTestResult()
 
 	// Create request to add a member to a group.
@@ -187,7 +214,6 @@ func AddGroupMember(groupID, userID, jwtToken, authDomain string) TestResult {
 	addGroupMemberRequest.Header.Add("Content-Type", "application/json")
 
 	// Perform request.
-	httpClient := &http.Client{}
 	addGroupMemberResponse, err := httpClient.Do(addGroupMemberRequest)
 	if err != nil {
 		panic(err)
@@ -214,7 +240,7 @@ func AddGroupMember(groupID, userID, jwtToken, authDomain string) TestResult {
 	return addGroupMemberResult
 }
 
-func DeleteUser(userID, jwtToken, authDomain string) TestResult {
+func DeleteUser(httpClient *http.Client, userID, jwtToken, authDomain string) TestResult {
 	deleteUserTestResult := defaultTestResult()
 
 	// Create request to delete user.
@@ -227,7 +253,6 @@ func DeleteUser(userID, jwtToken, authDomain string) TestResult {
 	userDeleteRequest.Header.Add("Content-Type", "application/json")
 	userDeleteRequest.Header.Add("Authorization", "Bearer "+jwtToken)
 
-	httpClient := &http.Client{}
 	userDeleteResponse, err := httpClient.Do(userDeleteRequest)
 	if err != nil {
 		panic(err)
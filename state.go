@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stateStore keeps state that must survive a restart or push of the app, such as availability, canary
+// markers and maintenance windows, as JSON files in a directory. The directory should be on a volume service
+// mount: the container disk is wiped on restart. Without a directory, state is only kept in memory.
+type stateStore struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+func stateStoreNew(dir string) *stateStore {
+	if dir == "" {
+		log.Printf("STATE_DIR not set: availability, canary state and maintenance windows are lost when the app restarts")
+	}
+	return &stateStore{dir: dir}
+}
+
+// load reads the named state into v. Missing state is not an error and leaves v untouched.
+func (s *stateStore) load(name string, v interface{}) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// save writes the named state. The file is replaced atomically, so a crash never leaves half of it behind.
+func (s *stateStore) save(name string, v interface{}) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := filepath.Join(s.dir, name+".json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
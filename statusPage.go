@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Number of runs shown in the sparkline of each test.
+const sparklineRuns = 50
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"sparkline": sparkline,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>Smoke tests</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; vertical-align: top; }
+.pass { color: #2e7d32; }
+.fail { color: #c62828; font-weight: bold; }
+.degraded { color: #ef6c00; }
+.test { margin-bottom: 1em; }
+.error { color: #c62828; white-space: pre-wrap; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>Smoke tests</h1>
+{{if .Found}}
+<p class="muted">Run {{.Run.ID}} started {{.Run.Started.Format "2006-01-02 15:04:05 MST"}}, took {{.Run.Finished.Sub .Run.Started}}.</p>
+{{range .Run.Results}}
+<div class="test">
+<h2 class="{{if .Degraded}}degraded{{else if .Result}}pass{{else if .Maintenance}}muted{{else}}fail{{end}}">{{.Name}} {{if .Degraded}}&#9888;{{else if .Result}}&#10004;{{else}}&#10008;{{end}}</h2>
+{{if .Maintenance}}<p class="muted">In maintenance: {{.Maintenance}}</p>{{end}}
+{{if .Degraded}}<p class="degraded">{{.Details}}</p>{{end}}
+<p>{{sparkline .Key}} <span class="muted">{{.DurationMs}} ms &middot; <a href="/v1/badge/{{.Key}}.svg">badge</a></span></p>
+{{if .Error}}<p class="error">{{.Error}}{{if .ErrorDescription}}: {{.ErrorDescription}}{{end}}</p>{{end}}
+{{if .Results}}
+<table>
+<tr><th>Step</th><th>Result</th><th>Duration</th><th>Error</th></tr>
+{{range .Results}}
+<tr>
+<td>{{.Name}}</td>
+<td class="{{if .Degraded}}degraded{{else if .Result}}pass{{else if .Skipped}}muted{{else}}fail{{end}}">{{if .Degraded}}degraded{{else if .Result}}passed{{else if .Skipped}}skipped{{else}}failed{{end}}</td>
+<td>{{if .DurationMs}}{{.DurationMs}} ms{{end}}</td>
+<td class="{{if .Degraded}}degraded{{else}}error{{end}}">{{.Error}}{{if .ErrorDescription}}: {{.ErrorDescription}}{{end}}{{if .Details}} <span class="muted">{{.Details}}</span>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</div>
+{{end}}
+{{else}}
+<p>No tests have run yet. Results appear here after the next call to <a href="/v1/status">/v1/status</a>.</p>
+{{end}}
+</body>
+</html>
+`))
+
+func handlerStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	run, found := program.history().latest()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := statusPageTemplate.Execute(w, struct {
+		Found bool
+		Run   runRecord
+	}{found, run})
+	if err != nil {
+		log.Printf("Unable to render status page: %v", err)
+	}
+}
+
+// sparkline renders the most recent results of a test as an inline SVG: one bar per run, of which the
+// height reflects the duration and the colour the result (degraded, or maintenance).
+func sparkline(key string) template.HTML {
+	points := program.history().forKey(key)
+	if len(points) > sparklineRuns {
+		points = points[len(points)-sparklineRuns:]
+	}
+
+	var longest int64 = 1
+	for _, p := range points {
+		if p.DurationMs > longest {
+			longest = p.DurationMs
+		}
+	}
+
+	const width, height, barWidth = 4, 20, 3
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`, width*sparklineRuns, height)
+	for i, p := range points {
+		colour := "#2e7d32"
+		if p.Maintenance != "" {
+			colour = "#1565c0"
+		} else if !p.Result {
+			colour = "#c62828"
+		} else if p.Degraded {
+			colour = "#ef6c00"
+		}
+		barHeight := 2 + int(p.DurationMs*(height-2)/longest)
+		fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"><title>%s: %d ms</title></rect>`,
+			i*width, height-barHeight, barWidth, barHeight, colour, p.Time.Format("2006-01-02 15:04:05"), p.DurationMs)
+	}
+	svg.WriteString(`</svg>`)
+
+	return template.HTML(svg.String())
+}
+
+// handlerBadge serves /v1/badge/{key}.svg: a badge with the latest result of a single test.
+func handlerBadge(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/badge/"), ".svg")
+
+	label, message, colour := key, "unknown", "#9e9e9e"
+	if run, found := program.history().latest(); found {
+		for _, result := range run.Results {
+			if result.Key != key {
+				continue
+			}
+			label = strings.ReplaceAll(result.Name, "\n", " ")
+			if result.Maintenance != "" {
+				message, colour = "maintenance", "#1565c0"
+			} else if result.Degraded {
+				message, colour = "degraded", "#ef6c00"
+			} else if result.Result {
+				message, colour = "passing", "#2e7d32"
+			} else {
+				message, colour = "failing", "#c62828"
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(badge(label, message, colour)))
+}
+
+// badge renders a badge in the style of shields.io. Text width is estimated, as there is no font metrics
+// available.
+func badge(label, message, colour string) string {
+	labelWidth := 10 + 7*len(label)
+	messageWidth := 10 + 7*len(message)
+	width := labelWidth + messageWidth
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[2]s: %[3]s">`+
+		`<title>%[2]s: %[3]s</title>`+
+		`<rect width="%[4]d" height="20" fill="#555"/>`+
+		`<rect x="%[4]d" width="%[5]d" height="20" fill="%[6]s"/>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="%[7]d" y="14">%[2]s</text><text x="%[8]d" y="14">%[3]s</text></g></svg>`,
+		width, html.EscapeString(label), html.EscapeString(message), labelWidth, messageWidth, colour,
+		labelWidth/2, labelWidth+messageWidth/2)
+}
+
+func handlerHistory(w http.ResponseWriter, r *http.Request) {
+	if key := r.URL.Query().Get("key"); key != "" {
+		writeJSON(w, program.history().forKey(key))
+		return
+	}
+	writeJSON(w, program.history().all())
+}
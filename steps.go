@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// StepFunc performs a single step of a test. It may annotate the result of the step, e.g. with a status code
+// or metrics; the framework takes care of the name, outcome and duration.
+type StepFunc func(*SmokeTestResult) error
+
+// TestStep is a named step of a test. A step only runs when all steps it depends on passed. Cleanup steps
+// run after all other steps, in reverse order, so resources are removed even when a later step failed.
+type TestStep struct {
+	Name      string
+	DependsOn []string
+	Cleanup   bool
+	Run       StepFunc
+}
+
+// testPlan declares the steps of a test and assembles their results:
+//
+//	plan := testPlanNew(key, name)
+//	plan.step("Open connection", open)
+//	plan.step("Insert record", insert, "Open connection")
+//	plan.cleanup("Delete record", remove, "Insert record")
+//	return plan.run()
+type testPlan struct {
+	key   string
+	name  string
+	steps []TestStep
+}
+
+// DegradedError marks a step that passed, but found something that needs attention.
+type DegradedError struct {
+	message string
+}
+
+func (e *DegradedError) Error() string {
+	return e.message
+}
+
+// degraded returns an error that marks a step as degraded instead of failed.
+func degraded(format string, args ...interface{}) error {
+	return &DegradedError{message: fmt.Sprintf(format, args...)}
+}
+
+func testPlanNew(key, name string) *testPlan {
+	return &testPlan{key: key, name: name}
+}
+
+func (p *testPlan) step(name string, run StepFunc, dependsOn ...string) {
+	p.steps = append(p.steps, TestStep{Name: name, DependsOn: dependsOn, Run: run})
+}
+
+func (p *testPlan) cleanup(name string, run StepFunc, dependsOn ...string) {
+	p.steps = append(p.steps, TestStep{Name: name, DependsOn: dependsOn, Cleanup: true, Run: run})
+}
+
+// run executes the steps in dependency order (and otherwise in the order they were declared), skips steps
+// of which a dependency did not pass and returns the overall result.
+func (p *testPlan) run() SmokeTestResult {
+	results := make([]SmokeTestResult, 0, len(p.steps))
+	passed := make(map[string]bool)
+	done := make(map[string]bool)
+
+	execute := func(step TestStep) {
+		done[step.Name] = true
+		for _, dependency := range step.DependsOn {
+			if !passed[dependency] {
+				results = append(results, SmokeTestResult{Name: step.Name, Result: false, Skipped: true, Error: fmt.Sprintf("Skipped: %s did not pass", dependency)})
+				currentRun.stepCompleted(results[len(results)-1])
+				return
+			}
+		}
+
+		result := runStep(step.Name, step.Run)
+		passed[step.Name] = result.Result
+		results = append(results, result)
+	}
+
+	// Regular steps: repeatedly run the first step of which all dependencies have been dealt with.
+	var regular, cleanup []TestStep
+	for _, step := range p.steps {
+		if step.Cleanup {
+			cleanup = append(cleanup, step)
+		} else {
+			regular = append(regular, step)
+		}
+	}
+	for len(regular) > 0 {
+		next := -1
+		for i, step := range regular {
+			if p.ready(step, done) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			// What is left depends on unknown steps or on each other: report rather than loop forever.
+			for _, step := range regular {
+				results = append(results, SmokeTestResult{Name: step.Name, Result: false, Error: fmt.Sprintf("Unresolvable dependencies: %v", step.DependsOn)})
+			}
+			break
+		}
+		execute(regular[next])
+		regular = append(regular[:next], regular[next+1:]...)
+	}
+
+	for i := len(cleanup) - 1; i >= 0; i-- {
+		execute(cleanup[i])
+	}
+
+	return OverallResult(p.key, p.name, results)
+}
+
+// ready determines whether all dependencies of a step have been dealt with.
+func (p *testPlan) ready(step TestStep, done map[string]bool) bool {
+	for _, dependency := range step.DependsOn {
+		if !done[dependency] {
+			return false
+		}
+	}
+	return true
+}
+
+// testPartStep turns a TestPart into a step.
+func testPartStep(testPart TestPart) StepFunc {
+	return func(*SmokeTestResult) error {
+		_, err := testPart()
+		return err
+	}
+}
+
+// runStep runs a single step: it times the step, turns a panic into a failure and reports the outcome to
+// the current run.
+func runStep(name string, step StepFunc) SmokeTestResult {
+	result := SmokeTestResult{Name: name, Result: true}
+
+	started := time.Now()
+	err := runStepFunc(step, &result)
+	result.DurationMs = time.Since(started).Milliseconds()
+
+	var degradedErr *DegradedError
+	if errors.As(err, &degradedErr) {
+		result.Degraded = true
+		result.Error = err.Error()
+	} else if err != nil {
+		fmt.Println(err.Error())
+		result.Result = false
+		result.Error = err.Error()
+	}
+
+	currentRun.stepCompleted(result)
+	return result
+}
+
+// runStepFunc runs a step and turns a panic into an error.
+func runStepFunc(step StepFunc, result *SmokeTestResult) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+
+	return step(result)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// errPanic makes a step panic instead of returning an error.
+var errPanic = errors.New("panic")
+
+type stepOutcome struct {
+	name     string
+	result   bool
+	skipped  bool
+	degraded bool
+}
+
+func TestTestPlanRun(t *testing.T) {
+	tests := []struct {
+		name         string
+		steps        []TestStep
+		errors       map[string]error
+		wantRun      []string
+		wantOutcomes []stepOutcome
+		wantResult   bool
+		wantDegraded bool
+	}{
+		{
+			name:    "steps without dependencies run in declaration order",
+			steps:   []TestStep{{Name: "a"}, {Name: "b"}, {Name: "c"}},
+			wantRun: []string{"a", "b", "c"},
+			wantOutcomes: []stepOutcome{
+				{name: "a", result: true},
+				{name: "b", result: true},
+				{name: "c", result: true},
+			},
+			wantResult: true,
+		},
+		{
+			name:    "a step waits for a dependency declared after it",
+			steps:   []TestStep{{Name: "b", DependsOn: []string{"a"}}, {Name: "a"}, {Name: "c"}},
+			wantRun: []string{"a", "b", "c"},
+			wantOutcomes: []stepOutcome{
+				{name: "a", result: true},
+				{name: "b", result: true},
+				{name: "c", result: true},
+			},
+			wantResult: true,
+		},
+		{
+			name:    "steps depending on a failed step are skipped, transitively",
+			steps:   []TestStep{{Name: "a"}, {Name: "b", DependsOn: []string{"a"}}, {Name: "c", DependsOn: []string{"b"}}, {Name: "d"}},
+			errors:  map[string]error{"a": errors.New("broken")},
+			wantRun: []string{"a", "d"},
+			wantOutcomes: []stepOutcome{
+				{name: "a"},
+				{name: "b", skipped: true},
+				{name: "c", skipped: true},
+				{name: "d", result: true},
+			},
+		},
+		{
+			name: "cleanup steps run last in reverse order, also after a failure",
+			steps: []TestStep{
+				{Name: "create a"},
+				{Name: "delete a", DependsOn: []string{"create a"}, Cleanup: true},
+				{Name: "create b", DependsOn: []string{"create a"}},
+				{Name: "delete b", DependsOn: []string{"create b"}, Cleanup: true},
+				{Name: "use", DependsOn: []string{"create b"}},
+			},
+			errors:  map[string]error{"use": errors.New("broken")},
+			wantRun: []string{"create a", "create b", "use", "delete b", "delete a"},
+			wantOutcomes: []stepOutcome{
+				{name: "create a", result: true},
+				{name: "create b", result: true},
+				{name: "use"},
+				{name: "delete b", result: true},
+				{name: "delete a", result: true},
+			},
+		},
+		{
+			name: "a cleanup step is skipped when its create step failed",
+			steps: []TestStep{
+				{Name: "create a"},
+				{Name: "delete a", DependsOn: []string{"create a"}, Cleanup: true},
+				{Name: "create b"},
+				{Name: "delete b", DependsOn: []string{"create b"}, Cleanup: true},
+			},
+			errors:  map[string]error{"create b": errors.New("broken")},
+			wantRun: []string{"create a", "create b", "delete a"},
+			wantOutcomes: []stepOutcome{
+				{name: "create a", result: true},
+				{name: "create b"},
+				{name: "delete b", skipped: true},
+				{name: "delete a", result: true},
+			},
+		},
+		{
+			name:    "steps with unknown or circular dependencies are reported without running",
+			steps:   []TestStep{{Name: "a"}, {Name: "b", DependsOn: []string{"unknown"}}, {Name: "c", DependsOn: []string{"d"}}, {Name: "d", DependsOn: []string{"c"}}},
+			wantRun: []string{"a"},
+			wantOutcomes: []stepOutcome{
+				{name: "a", result: true},
+				{name: "b"},
+				{name: "c"},
+				{name: "d"},
+			},
+		},
+		{
+			name:    "a degraded step passes and lets its dependents run",
+			steps:   []TestStep{{Name: "a"}, {Name: "b", DependsOn: []string{"a"}}},
+			errors:  map[string]error{"a": degraded("slow")},
+			wantRun: []string{"a", "b"},
+			wantOutcomes: []stepOutcome{
+				{name: "a", result: true, degraded: true},
+				{name: "b", result: true},
+			},
+			wantResult:   true,
+			wantDegraded: true,
+		},
+		{
+			name:    "a panicking step fails",
+			steps:   []TestStep{{Name: "a"}, {Name: "b", DependsOn: []string{"a"}}},
+			errors:  map[string]error{"a": errPanic},
+			wantRun: []string{"a"},
+			wantOutcomes: []stepOutcome{
+				{name: "a"},
+				{name: "b", skipped: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var run []string
+			plan := testPlanNew("key", "name")
+			for _, step := range tt.steps {
+				name := step.Name
+				stepFunc := func(*SmokeTestResult) error {
+					run = append(run, name)
+					if tt.errors[name] == errPanic {
+						panic("step " + name + " panicked")
+					}
+					return tt.errors[name]
+				}
+				if step.Cleanup {
+					plan.cleanup(name, stepFunc, step.DependsOn...)
+				} else {
+					plan.step(name, stepFunc, step.DependsOn...)
+				}
+			}
+
+			result := plan.run()
+
+			if !reflect.DeepEqual(run, tt.wantRun) {
+				t.Errorf("ran %v, want %v", run, tt.wantRun)
+			}
+			var outcomes []stepOutcome
+			for _, step := range result.Results {
+				outcomes = append(outcomes, stepOutcome{name: step.Name, result: step.Result, skipped: step.Skipped, degraded: step.Degraded})
+			}
+			if !reflect.DeepEqual(outcomes, tt.wantOutcomes) {
+				t.Errorf("outcomes %+v, want %+v", outcomes, tt.wantOutcomes)
+			}
+			if result.Result != tt.wantResult || result.Degraded != tt.wantDegraded {
+				t.Errorf("result %v, degraded %v, want %v, %v", result.Result, result.Degraded, tt.wantResult, tt.wantDegraded)
+			}
+		})
+	}
+}
+
+func TestTestPlanRunReportsReasons(t *testing.T) {
+	plan := testPlanNew("key", "name")
+	plan.step("a", func(*SmokeTestResult) error { return errors.New("broken") })
+	plan.step("b", func(*SmokeTestResult) error { return nil }, "a")
+	plan.step("c", func(*SmokeTestResult) error { panic("boom") })
+	plan.step("d", func(*SmokeTestResult) error { return nil }, "unknown")
+
+	result := plan.run()
+
+	wantErrors := map[string]string{
+		"a": "broken",
+		"b": "Skipped: a did not pass",
+		"c": "boom",
+		"d": "Unresolvable dependencies: [unknown]",
+	}
+	for _, step := range result.Results {
+		if !strings.Contains(step.Error, wantErrors[step.Name]) {
+			t.Errorf("step %s: error %q, want it to contain %q", step.Name, step.Error, wantErrors[step.Name])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Every resource created by a smoke test carries a prefix followed by its creation time (unix seconds),
+	// e.g. "smoketest-1697700000". This allows the sweeper to recognise resources left behind by an
+	// interrupted run and to decide whether they are old enough to be removed.
+	smokeTestResourcePrefix = "smoketest-"
+
+	// Kubernetes labels put on every object created by the k8s test.
+	smokeTestManagedByLabel = "app.kubernetes.io/managed-by"
+	smokeTestManagedBy      = "cf-smoketests"
+	smokeTestCreatedLabel   = "smoketests/created"
+)
+
+// Sweeper is implemented by smoke tests that create resources which outlive a run when the app is killed
+// halfway. sweep removes all resources created before the given time and returns a description of each
+// resource it removed.
+type Sweeper interface {
+	sweep(createdBefore time.Time) ([]string, error)
+}
+
+// SweepReport describes the outcome of a single sweep over all tests.
+type SweepReport struct {
+	Started time.Time `json:"started"`
+	TTL     string    `json:"ttl"`
+	Removed []string  `json:"removed"`
+	Errors  []string  `json:"errors,omitempty"`
+}
+
+// resourceName returns the name for a resource created at the given time.
+func resourceName(prefix string, created time.Time) string {
+	return fmt.Sprintf("%s%d", prefix, created.Unix())
+}
+
+// resourceCreated parses the creation time from a name returned by resourceName. Anything following
+// the timestamp (e.g. "smoketest-1697700000-svc") is ignored.
+func resourceCreated(prefix, name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, false
+	}
+	timestamp := strings.TrimPrefix(name, prefix)
+	if i := strings.IndexFunc(timestamp, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		timestamp = timestamp[:i]
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+func (s *smokeTestProgram) sweep() SweepReport {
+	report := SweepReport{Started: time.Now(), TTL: s.config.SweepTTL.String(), Removed: []string{}}
+	createdBefore := report.Started.Add(-s.config.SweepTTL)
+
+	for _, sweeper := range s.sweepers {
+		removed, err := sweepTest(sweeper, createdBefore)
+		report.Removed = append(report.Removed, removed...)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	for _, r := range report.Removed {
+		log.Printf("Sweeper removed orphaned resource: %s", r)
+	}
+	for _, e := range report.Errors {
+		log.Printf("Sweeper error: %s", e)
+	}
+
+	s.sweepMutex.Lock()
+	s.lastSweepReport = report
+	s.sweepMutex.Unlock()
+
+	return report
+}
+
+// sweepTest runs a single sweeper. The sweeper runs outside of a request, so a panic would take down the app.
+func sweepTest(sweeper Sweeper, createdBefore time.Time) (removed []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Sweeper %T failed: %v", sweeper, panicError(r))
+		}
+	}()
+
+	return sweeper.sweep(createdBefore)
+}
+
+func (s *smokeTestProgram) lastSweep() SweepReport {
+	s.sweepMutex.Lock()
+	defer s.sweepMutex.Unlock()
+
+	return s.lastSweepReport
+}
+
+// sweepPeriodically sweeps once immediately and then every interval. A zero interval only sweeps once.
+func sweepPeriodically(p SmokeTestProgram, interval time.Duration) {
+	for {
+		p.sweep()
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResourceCreated(t *testing.T) {
+	created := time.Unix(1697700000, 0)
+
+	tests := []struct {
+		name        string
+		prefix      string
+		resource    string
+		wantCreated time.Time
+		wantOK      bool
+	}{
+		{name: "name of resourceName", prefix: smokeTestResourcePrefix, resource: resourceName(smokeTestResourcePrefix, created), wantCreated: created, wantOK: true},
+		{name: "suffix after the timestamp", prefix: smokeTestResourcePrefix, resource: "smoketest-1697700000-svc", wantCreated: created, wantOK: true},
+		{name: "nanosecond suffix", prefix: smokeTestResourcePrefix, resource: "smoketest-1697700000-000000042", wantCreated: created, wantOK: true},
+		{name: "other prefix", prefix: uaaSmokeUsernamePrefix, resource: "smokeuser-1697700000", wantCreated: created, wantOK: true},
+		{name: "foreign resource", prefix: smokeTestResourcePrefix, resource: "orders-1697700000"},
+		{name: "prefix of another test", prefix: smokeTestResourcePrefix, resource: "smokeuser-1697700000"},
+		{name: "no timestamp", prefix: smokeTestResourcePrefix, resource: "smoketest-"},
+		{name: "no digits after the prefix", prefix: smokeTestResourcePrefix, resource: "smoketest-queue"},
+		{name: "timestamp out of range", prefix: smokeTestResourcePrefix, resource: "smoketest-99999999999999999999"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := resourceCreated(tt.prefix, tt.resource)
+			if ok != tt.wantOK || !got.Equal(tt.wantCreated) {
+				t.Errorf("resourceCreated(%q, %q) = %v, %v, want %v, %v", tt.prefix, tt.resource, got, ok, tt.wantCreated, tt.wantOK)
+			}
+		})
+	}
+}
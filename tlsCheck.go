@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsObserver records the state of the most recent TLS connection made with a TLS configuration, so tests
+// can report on connections that are made deep inside a driver.
+type tlsObserver struct {
+	mutex sync.Mutex
+	state *tls.ConnectionState
+}
+
+// tlsObserverNew returns an observer and a copy of the TLS configuration that reports to it. The server
+// certificate is still verified as usual; the observer only sees connections that passed verification.
+func tlsObserverNew(config *tls.Config) (*tlsObserver, *tls.Config) {
+	observer := &tlsObserver{}
+	observed := config.Clone()
+	observed.VerifyConnection = func(state tls.ConnectionState) error {
+		observer.mutex.Lock()
+		defer observer.mutex.Unlock()
+		observer.state = &state
+		return nil
+	}
+	return observer, observed
+}
+
+// last returns the state of the most recent connection.
+func (o *tlsObserver) last() (tls.ConnectionState, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.state == nil {
+		return tls.ConnectionState{}, false
+	}
+	return *o.state, true
+}
+
+// tlsReport describes the negotiated TLS version and the server certificate in the result of a step. The
+// step is degraded when the certificate expires within expiryWarning.
+func tlsReport(state tls.ConnectionState, expiryWarning time.Duration, result *SmokeTestResult) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("Server presented no certificate")
+	}
+
+	version, ok := tlsVersionNames[state.Version]
+	if !ok {
+		version = fmt.Sprintf("TLS 0x%04x", state.Version)
+	}
+	cert := state.PeerCertificates[0]
+	expiresIn := time.Until(cert.NotAfter)
+	result.Details = fmt.Sprintf("%s, %s, certificate %s expires %s (in %d days)", version, tls.CipherSuiteName(state.CipherSuite),
+		cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339), int(expiresIn.Hours()/24))
+
+	if expiresIn < expiryWarning {
+		return degraded("Server certificate %s expires %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}